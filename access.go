@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// An access rule grants (or denies) the clients matching all of the given
+// identities read access to the listed module patterns.  Rules are evaluated
+// in order and the first rule matching both the client and the module
+// decides.  Patterns are regular expressions which must match the whole value.
+type yamlAccess struct {
+	Subject string            `yaml:"cert-subject"` // ie: CN=builder-.*,OU=CI,O=Company
+	OU      string            `yaml:"cert-ou"`
+	SAN     string            `yaml:"cert-san"` // DNS, email, URI or IP subject alt name
+	CIDR    []string          `yaml:"cidr"`     // client addresses, ie: 10.1.0.0/16 or 10.1.2.3
+	Tokens  []*secret         `yaml:"tokens"`   // bearer tokens or basic auth passwords, ${ENV} or file:/path
+	Claims  map[string]string `yaml:"claims"`   // claims of a valid OIDC token, ie: project_path: "group/.*"
+	Modules []string          `yaml:"modules"`  // modules or repositories which may be read, all when empty
+	Deny    bool              `yaml:"deny"`     // refuse instead of allow
+
+	subject, ou, san *regexp.Regexp
+	nets             []*net.IPNet
+	claims           map[string]*regexp.Regexp
+	modules          []*regexp.Regexp
+}
+
+// The identities presented by the client with a request.  The bearer token is
+// only verified as an OIDC token when a rule asks for its claims.
+type identity struct {
+	r        *http.Request
+	cert     *x509.Certificate
+	token    string
+	claims   map[string]interface{}
+	verified bool
+}
+
+func newIdentity(r *http.Request) *identity {
+	return &identity{r: r, cert: clientCert(r), token: requestToken(r)}
+}
+
+// jwtClaims returns the claims of the bearer token, or nil when it is not a
+// valid token from a trusted issuer.
+func (id *identity) jwtClaims() map[string]interface{} {
+	if !id.verified {
+		id.verified = true
+		if c := configOf(id.r); id.token != "" && len(c.OIDC) > 0 {
+			claims, err := verifyJWT(c, id.token)
+			if err != nil && err != errNotJWT {
+				logOf(id.r.Context(), "access").Debug("Invalid token", "client", id.r.RemoteAddr, "err", err)
+			}
+			id.claims = claims
+		}
+	}
+	return id.claims
+}
+
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// setClientAuth sets up the verification of client certificates, which can
+// only be done at startup.
+func setClientAuth(data *yamlParse) {
+	tlsConfig.ClientAuth = clientAuthType(data.ClientAuth)
+	if data.ClientCA != "" {
+		// Client certificates are only trusted from their own CAs, not the
+		// ones of the servers
+		pool := x509.NewCertPool()
+		if err := loadCertPool(data.ClientCA, pool); err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	for _, l := range listenersOf(data) {
+		if l.TLS {
+			return
+		}
+	}
+	if data.ClientAuth != "" && data.ClientAuth != "none" {
+		newLogger("config").Warn("client-auth has no effect without a TLS listener")
+	}
+}
+
+func clientAuthType(mode string) tls.ClientAuthType {
+	switch mode {
+	case "request":
+		return tls.VerifyClientCertIfGiven
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+func checkClientAuth(mode string) error {
+	switch mode {
+	case "", "none", "request", "require":
+		return nil
+	}
+	return fmt.Errorf("unknown client-auth %q, expected none, request or require", mode)
+}
+
+func (data *yamlParse) loadAccess() error {
+	if err := checkClientAuth(data.ClientAuth); err != nil {
+		return err
+	}
+	if data.ClientCA == "" {
+		verify := data.ClientAuth != "" && data.ClientAuth != "none"
+		for _, l := range data.Listeners {
+			verify = verify || l.ClientAuth != "" && l.ClientAuth != "none"
+		}
+		if verify {
+			return fmt.Errorf("client-auth needs a client-ca file with the CAs of the client certificates")
+		}
+	}
+	if err := compileAccess(data.Access); err != nil {
+		return err
+	}
+	newLogger("config").Debug("Found access rules", "count", len(data.Access))
+	return nil
+}
+
+// compileAccess compiles the patterns of the rules and reads in their tokens.
+func compileAccess(rules []yamlAccess) error {
+	var err error
+	for i := range rules {
+		a := &rules[i]
+		if a.subject, err = compileAnchored(a.Subject); err != nil {
+			return fmt.Errorf("error compiling cert-subject %q: %w", a.Subject, err)
+		}
+		if a.ou, err = compileAnchored(a.OU); err != nil {
+			return fmt.Errorf("error compiling cert-ou %q: %w", a.OU, err)
+		}
+		if a.san, err = compileAnchored(a.SAN); err != nil {
+			return fmt.Errorf("error compiling cert-san %q: %w", a.SAN, err)
+		}
+		for k, t := range a.Tokens {
+			if a.Tokens[k], err = loadSecret(t, "", ""); err != nil {
+				return fmt.Errorf("error reading access token: %w", err)
+			}
+		}
+		for _, c := range a.CIDR {
+			if !strings.Contains(c, "/") {
+				if strings.Contains(c, ":") {
+					c += "/128"
+				} else {
+					c += "/32"
+				}
+			}
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return fmt.Errorf("error parsing cidr %q: %w", c, err)
+			}
+			a.nets = append(a.nets, n)
+		}
+		for claim, expr := range a.Claims {
+			re, err := compileAnchored(expr)
+			if err != nil {
+				return fmt.Errorf("error compiling claim pattern %s: %q: %w", claim, expr, err)
+			}
+			if a.claims == nil {
+				a.claims = make(map[string]*regexp.Regexp)
+			}
+			a.claims[claim] = re
+		}
+		for _, m := range a.Modules {
+			re, err := compileAnchored("(?i)" + m)
+			if err != nil {
+				return fmt.Errorf("error compiling module pattern %q: %w", m, err)
+			}
+			a.modules = append(a.modules, re)
+		}
+	}
+	return nil
+}
+
+// user names the client for the logs, from the basic auth user name or the
+// subject of an OIDC token.
+func (id *identity) user() string {
+	if name, _, ok := id.r.BasicAuth(); ok && name != "" {
+		return name
+	}
+	if claims := id.jwtClaims(); claims != nil {
+		if sub, ok := claims["sub"].(string); ok {
+			return sub
+		}
+	}
+	if id.token != "" {
+		return "token"
+	}
+	return ""
+}
+
+// matchClient reports whether the client making the request has all the
+// identities of the rule.  Rules without identities match any client.
+func (a *yamlAccess) matchClient(id *identity) bool {
+	if len(a.nets) > 0 {
+		host, _, err := net.SplitHostPort(id.r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !containsIP(a.nets, ip) {
+			return false
+		}
+	}
+	if len(a.Tokens) > 0 && !hasToken(a.Tokens, id.token) {
+		return false
+	}
+	if len(a.claims) > 0 {
+		claims := id.jwtClaims()
+		if claims == nil {
+			return false
+		}
+		for name, re := range a.claims {
+			if !matchClaim(claims[name], re.MatchString) {
+				return false
+			}
+		}
+	}
+	if a.subject == nil && a.ou == nil && a.san == nil {
+		return true
+	}
+	cert := id.cert
+	if cert == nil {
+		return false
+	}
+	if a.subject != nil && !a.subject.MatchString(certPKIXString(cert.Subject, ",")) {
+		return false
+	}
+	if a.ou != nil && !matchAny(a.ou, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+	if a.san != nil && !matchAny(a.san, certSANs(cert)) {
+		return false
+	}
+	return true
+}
+
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0]
+	}
+	return nil
+}
+
+// requestToken returns the bearer token, or the basic auth password as sent
+// by the go command from .netrc.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	_, pass, _ := r.BasicAuth()
+	return pass
+}
+
+func hasToken(tokens []*secret, token string) bool {
+	if token == "" {
+		return false
+	}
+	found := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Value()), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *yamlAccess) allowsModule(names []string) bool {
+	if len(a.modules) == 0 {
+		return true
+	}
+	for _, re := range a.modules {
+		if matchAny(re, names) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleNames lists what the rules are matched against for a module: its
+// path, the path it is mapped to and the repository on the git server.  Any
+// module path may map to a repository, and git servers ignore the case of
+// paths, so a rule naming either the module or the repository applies
+// whatever path the client asks for.
+func moduleNames(r *http.Request, module string) []string {
+	names := []string{strings.ToLower(module)}
+	if module == "" {
+		return names
+	}
+	lr, ok := configOf(r).Lookup(r.Context(), module)
+	if !ok {
+		return names
+	}
+	host := lr.gitURL
+	if u, err := url.Parse(lr.gitURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	for _, name := range []string{
+		path.Join(lr.baseGroupRepo, lr.path),
+		path.Join(host, lr.groupRepo, lr.path),
+	} {
+		names = append(names, strings.ToLower(name))
+	}
+	return names
+}
+
+func matchAny(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func certSANs(cert *x509.Certificate) (sans []string) {
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return
+}
+
+// accessControl is the middleware enforcing the access rules of the listener
+// in front of all routes.  Denied requests get the same reply as unknown
+// modules so nothing is disclosed about which modules exist.
+func accessControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules, ok := accessRules(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, module, _ := requestKind(r.URL.Path)
+		if unescaped, err := unescapePath(module); err == nil {
+			module = unescaped
+		}
+		names := moduleNames(r, module)
+		id := identityOf(r)
+		for i := range rules {
+			a := &rules[i]
+			if a.allowsModule(names) && a.matchClient(id) {
+				if a.Deny {
+					break
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if l := logOf(r.Context(), "access"); l.Enabled(levelDebug) {
+			sub := "<none>"
+			if id.cert != nil {
+				sub = certPKIXString(id.cert.Subject, ",")
+			}
+			l.Debug("Access denied", "module", module, "repo", names[len(names)-1], "client", r.RemoteAddr, "cert", sub)
+		}
+		http.NotFound(w, r)
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessControlNames(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		gitURL string
+		deny   string
+		allow  []string // the rest is denied
+		denied []string
+	}{
+		{
+			// the modules are named after the GitLab host
+			gitURL: "https://company.com",
+			deny:   "company.com/security/.*",
+			allow:  []string{"company.com/public/lib", "evil.com/public/lib", "x.org/lib"},
+			denied: []string{
+				"company.com/security/tool",
+				"evil.com/security/tool",    // the default mapping ignores the host
+				"Company.com/Security/Tool", // and the git server the case
+				"company.com/SECURITY/tool/v2",
+				"x.org/tool", // replaced
+			},
+		},
+		{
+			// the repositories are protected on another host
+			gitURL: "https://gitlab.company.com",
+			deny:   "gitlab.company.com/security/.*",
+			allow:  []string{"company.com/public/lib", "evil.com/public/lib"},
+			denied: []string{
+				"company.com/security/tool",
+				"evil.com/security/tool",
+				"company.com/Security/tool/sub",
+				"x.org/tool",
+			},
+		},
+	}
+	for _, tt := range tests {
+		data := &yamlParse{
+			GitLabURL: tt.gitURL,
+			Modules:   map[string]string{"x.org/tool": "company.com/security/tool"},
+			Access:    []yamlAccess{{Deny: true, Modules: []string{tt.deny}}, {}},
+			gitClient: struct{}{}, // never called without probing
+		}
+		data.loadRules()
+		if err := compileAccess(data.Access); err != nil {
+			t.Fatal(err)
+		}
+		handler := accessControl(next)
+		check := func(module string, want int) {
+			esc, err := escapeString(module)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/"+esc+"/@v/list", nil)
+			r = r.WithContext(context.WithValue(r.Context(), configKey{}, data))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != want {
+				t.Errorf("git-url %s, deny %s: %s got %d, want %d", tt.gitURL, tt.deny, module, w.Code, want)
+			}
+		}
+		for _, m := range tt.allow {
+			check(m, http.StatusOK)
+		}
+		for _, m := range tt.denied {
+			check(m, http.StatusNotFound)
+		}
+	}
+}
@@ -3,200 +3,239 @@ package main
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"path"
 	"strconv"
 	"strings"
 
 	"github.com/google/go-github/v50/github"
-	"github.com/gorilla/mux"
 	"github.com/pschou/go-memdiskbuf"
-	"github.com/pschou/go-tease"
 	"github.com/xanzy/go-gitlab"
 )
 
 func archive(w http.ResponseWriter, r *http.Request) {
-	if *verbose {
-		log.Printf("Got archive request: %#v", r.RequestURI)
-	}
 	// find a project ID by module name
-	module := mux.Vars(r)["module"]
-	lr, ok := Lookup(module)
+	module, version, ok := requestModule(w, r)
+	if !ok {
+		return
+	}
+	lr, ok := lookup(w, r, module)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	if !useClientCredentials(w, r, lr) {
+		return
+	}
 
-	ver, notice := getVersion(lr, mux.Vars(r)["version"])
+	ver, notice, err := getVersion(r.Context(), lr, version)
+	if err != nil {
+		upstreamError(w, err)
+		return
+	}
 	if notice != "" {
 		http.Error(w, notice, http.StatusNotFound)
 		return
 	}
+	auditOf(r).version(&ver)
 
-	if ver.cachePath != "" { // Use cache if we got it!
-		if fh, err := os.Open(ver.cachePath); err == nil {
-			defer fh.Close()
-			writeZip(w, fh, module, lr.cleanPath, ver.Version)
+	if lr.conf.LocalCache != "" { // build the zip once and serve it from the cache
+		_, hit := cachedArtifacts(lr, module, ver.Version)
+		auditOf(r).cache(hit)
+		a, err := ensureArtifacts(r.Context(), lr, &ver, module)
+		if err != nil {
+			upstreamError(w, err)
+			return
+		}
+		if serveArtifact(w, r, a.zip, "application/zip") {
 			return
 		}
 	}
 
-	var tr *tease.Reader
+	fh, err := fetchArchive(r.Context(), lr, &ver)
+	if err != nil {
+		upstreamError(w, err)
+		return
+	}
+	defer fh.Close()
+
+	// build reply zip
+	writeZip(r.Context(), w, fh, lr, &ver, module)
+}
+
+// openArchive starts streaming the upstream tarball for the given version,
+// until ctx is done.
+func openArchive(ctx context.Context, lr *lookupResult, ver *VersionData) (io.ReadCloser, error) {
 	switch client := lr.git.(type) {
 	case *gitlab.Client:
 		pr, pw := io.Pipe()
-
-		var clientErr error
 		go func() {
 			format := "tar.gz"
-			_, clientErr = client.Repositories.StreamArchive(lr.groupRepo, pw, &gitlab.ArchiveOptions{
+			_, err := client.Repositories.StreamArchive(lr.groupRepo, pw, &gitlab.ArchiveOptions{
 				Format: &format,
 				SHA:    &ver.Origin.Hash,
-			})
-			pw.Close()
+			}, gitlab.WithContext(ctx))
+			pw.CloseWithError(err)
 		}()
-
-		pr.Read([]byte{}) // trigger a short read
-		if clientErr != nil {
-			http.Error(w, clientErr.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		tr = tease.NewReader(pr)
+		return pr, nil
 	case *github.Client:
-
 		link, _, err := client.Repositories.GetArchiveLink(ctx, lr.group, lr.repo, github.Tarball,
 			&github.RepositoryContentGetOptions{Ref: ver.Origin.Hash}, true)
 		if err != nil {
-			//log.Println("Could not get link", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if *verbose {
-			fmt.Println("got link: ", link.String())
+			return nil, err
 		}
+		logOf(ctx, "upstream").Debug("Got archive link", "url", link.String())
 
-		resp, err := http.Get(link.String())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, link.String(), nil)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		defer resp.Body.Close()
+		resp, err := lr.backend.archiveClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching archive: %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+	// Client is not set
+	return nil, fmt.Errorf("No git client available for %s", lr.orig)
+}
 
-		tr = tease.NewReader(resp.Body)
-	default:
-		// Client is not set
-		http.Error(w, "No git client available for "+module, http.StatusInternalServerError)
+// writeZip builds the module zip from the tarball and sends it as the reply.
+func writeZip(ctx context.Context, w http.ResponseWriter, r io.ReadSeeker, lr *lookupResult, ver *VersionData, module string) {
+	// Creates new memory buffer for our zip file
+	f, err := createTemp("", "goproxy-archive")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	f.Close()
+	buffer := memdiskbuf.NewBuffer(f.Name(), 200<<10, 32<<10)
+	defer func() {
+		buffer.Reset()
+		removeTemp(f.Name())
+	}()
 
-	var rdr io.ReadSeeker
-	_, err := gzip.NewReader(tr)
-	if err != nil { // We have a gzip stream!
-		http.Error(w, "Archive is not TGZ: "+module, http.StatusInternalServerError)
+	gomod, fileSums, err := buildZip(ctx, buffer, r, module, lr.folders(), ver.Version)
+	if err != nil {
+		logOf(ctx, "archive").Error("Error building module zip", "module", module, "version", ver.Version, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	tr.Seek(0, io.SeekStart)
-	if ver.cachePath != "" {
-		// Write the cache to disk
-		os.MkdirAll(ver.cacheDir, 0755)
-		if fh, err := os.Create(ver.cachePath); err == nil {
-			defer fh.Close()
-			tr.Pipe()
-			io.Copy(fh, tr)
-			fh.Seek(0, io.SeekStart)
-			rdr = fh
-		} else {
-			if *verbose {
-				log.Println("Error creating cache file:", err)
-			}
-			rdr = tr
-		}
-	} else {
-		rdr = tr
+	if err = ledgerCheck(lr, ledgerEntry{Module: lr.orig, Version: ver.Version, Hash: ver.Origin.Hash,
+		Sum: hashFiles(fileSums), ModSum: hashMod(moduleFile(gomod, lr))}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// build reply zip
-	writeZip(w, rdr, module, lr.cleanPath, ver.Version)
+	// write otput of buffer
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(buffer.Len()), 10))
+	io.Copy(w, buffer)
 }
 
-func writeZip(w http.ResponseWriter, r io.ReadSeeker, module, folder, finalVersion string) {
+// buildZip converts the tarball into a module zip written to dst, taking the
+// module from the first of the folders with a go.mod, or else the last.  The
+// go.mod of the module (if any) and the sums of the files added are returned
+// to allow checking the result.  The conversion stops once ctx is done.
+func buildZip(ctx context.Context, dst io.Writer, r io.ReadSeeker, module string, folders []string, finalVersion string) (gomod []byte, fileSums []fileSum, err error) {
+	metricConversions.add(1)
+	defer metricConversions.add(-1)
+	l := logOf(ctx, "archive").With("module", module, "version", finalVersion)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			abandoned(ctx, "zip")
+		}
+	}()
+
 	gz, err := gzip.NewReader(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	tr := tar.NewReader(gz)
 
-	// Make sure we select a folder
-	if folder != "" {
-		folder = folder + "/"
-	}
-
-	var ignorePaths []string
-
 	// Get all go.mod files in the archive locations
+	modDirs, licenses := make(map[string]bool), make(map[string]bool)
 	var item *tar.Header
 	for item, err = tr.Next(); err == nil; item, err = tr.Next() {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		if parts := strings.SplitN(item.Name, "/", 2); len(parts) > 1 {
 			dn, fn := path.Split(parts[1])
-			if *verbose {
-				fmt.Printf("name: %q dn: %q=%q fn=%q\n", item.Name, dn, folder, fn)
+			l.Debug("Tar entry", "name", item.Name, "dir", dn, "file", fn)
+			if fn == "go.mod" {
+				modDirs[dn] = true
 			}
-			if fn == "go.mod" && dn != folder {
-				ignorePaths = append(ignorePaths, dn)
+			if fn == "LICENSE" && item.Typeflag == tar.TypeReg {
+				licenses[dn] = true
 			}
 		}
 	}
 	if err != nil && err != io.EOF {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	//fmt.Println("rewinding")
+
+	// Make sure we select a folder
+	folder := folders[len(folders)-1]
+	for _, f := range folders {
+		if f != "" && modDirs[f+"/"] {
+			folder = f
+			break
+		}
+	}
+	if folder != "" {
+		folder = folder + "/"
+	}
+	var ignorePaths []string
+	for dn := range modDirs {
+		if dn != folder {
+			ignorePaths = append(ignorePaths, dn)
+		}
+	}
+	// A module in a folder without a LICENSE gets the one of the repo, as
+	// with the go command
+	rootLicense := folder != "" && !licenses[folder]
 
 	// Go back to the start
 	r.Seek(0, io.SeekStart)
-	gz, _ = gzip.NewReader(r)
-	tr = tar.NewReader(gz)
-
-	// Creates new memory buffer for our zip file
-	f, err := os.CreateTemp("", "goproxy-archive")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if gz, err = gzip.NewReader(r); err != nil {
 		return
 	}
-	f.Close()
-	buffer := memdiskbuf.NewBuffer(f.Name(), 200<<10, 32<<10)
-	defer func() {
-		buffer.Reset()
-		os.Remove(f.Name())
-	}()
-	writer := zip.NewWriter(buffer)
+	tr = tar.NewReader(gz)
+
+	writer := zip.NewWriter(dst)
 	directory := fmt.Sprintf("%s@%s", module, finalVersion)
 
 	// add unpacked files into buffer, with changed folder name
 zipfiles:
 	for item, err = tr.Next(); err == nil; item, err = tr.Next() {
-		if *verbose {
-			fmt.Println("tar item:", item.Name)
+		if err = ctx.Err(); err != nil {
+			return
 		}
+		l.Debug("Tar item", "name", item.Name)
 		parts := strings.SplitN(item.Name, "/", 2)
-		if len(parts) < 2 || parts[1] == "" || hasBadName(item.Name) {
-			if *verbose {
-				fmt.Println("  skip empty")
-			}
+		if len(parts) < 2 || parts[1] == "" {
+			l.Debug("Skipping empty item", "name", item.Name)
 			continue
 		}
-		if !strings.HasPrefix(parts[1], folder) {
-			if *verbose {
-				fmt.Println("  skip has prefix", parts[1], folder)
-			}
+		name := strings.TrimPrefix(parts[1], folder) // path in the module
+		if rootLicense && parts[1] == "LICENSE" {
+			name = "LICENSE"
+		} else if !strings.HasPrefix(parts[1], folder) {
+			l.Debug("Skipping item outside of the folder", "name", item.Name, "folder", folder)
+			continue
+		}
+		if isVendored(name) {
+			l.Debug("Skipping vendored item", "name", item.Name)
 			continue
 		}
 
@@ -204,9 +243,7 @@ zipfiles:
 		for _, ip := range ignorePaths {
 			if strings.HasPrefix(parts[1], ip) &&
 				strings.HasPrefix(ip, folder) { // Look for sub folders which have alternate go.mod
-				if *verbose {
-					fmt.Println("  skip ip", ip)
-				}
+				l.Debug("Skipping item of another module", "name", item.Name, "module_dir", ip)
 				continue zipfiles
 			}
 		}
@@ -214,14 +251,24 @@ zipfiles:
 		// Replace folder name with the module and verison name
 		switch item.Typeflag {
 		case tar.TypeReg:
-			file, err := writer.CreateHeader(&zip.FileHeader{
-				Name:     directory + "/" + parts[1],
+			fs := fileSum{name: directory + "/" + name, hash: sha256.New()}
+			var file io.Writer
+			file, err = writer.CreateHeader(&zip.FileHeader{
+				Name:     fs.name,
 				Modified: item.ModTime})
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			io.Copy(file, tr)
+			if name == "go.mod" { // keep a copy of the module's go.mod
+				var buf bytes.Buffer
+				if _, err = io.Copy(io.MultiWriter(file, fs.hash, &buf), tr); err != nil {
+					return
+				}
+				gomod = buf.Bytes()
+			} else if _, err = io.Copy(io.MultiWriter(file, fs.hash), tr); err != nil {
+				return
+			}
+			fileSums = append(fileSums, fs)
 			/*case tar.TypeDir:
 			_, err := writer.CreateHeader(&zip.FileHeader{
 				Name:     directory + "/" + parts[1],
@@ -234,32 +281,30 @@ zipfiles:
 
 	}
 	if err != nil && err != io.EOF {
-		log.Println("archive error", err, "for", module)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	writer.Flush()
 	err = writer.Close()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// write otput of buffer
-	w.Header().Set("Content-Length", strconv.FormatInt(int64(buffer.Len()), 10))
-	io.Copy(w, buffer)
+	return
 }
 
-func hasBadName(path string) bool {
-	parts := strings.Split(path, "/")
-	for _, p := range parts {
-		//if len(p) > 0 && p[0] == '.' ||
-		if p == "vendor" {
-			return true
-		}
+// isVendored tells the files of vendored packages, which the go command
+// leaves out of module zips.  Files directly in the top vendor folder, such
+// as vendor/modules.txt, are kept.
+func isVendored(name string) bool {
+	var i int
+	if strings.HasPrefix(name, "vendor/") {
+		i = len("vendor/")
+	} else if strings.Contains(name, "/vendor/") {
+		// As golang.org/x/mod/zip, which looks past the wrong offset for
+		// nested vendor folders (golang.org/issue/31562) and cannot change
+		// without changing the sums
+		i = len("/vendor/")
+	} else {
+		return false
 	}
-	return false
+	return strings.Contains(name[i:], "/")
 }
 
 /*func isGoFile(name string) bool {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIsVendored(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"vendor/modules.txt", false},
+		{"vendor/example.com/dep/dep.go", true},
+		{"vendor/vendored.go", false},
+		{"internal/vendor/vendored.go", true}, // as the go command does
+		{"internal/vendor/x/vendored.go", true},
+		{"vendored/file.go", false},
+		{"pkg/vendor.go", false},
+		{"go.mod", false},
+	}
+	for _, tt := range tests {
+		if got := isVendored(tt.name); got != tt.want {
+			t.Errorf("isVendored(%q) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildZipFolders(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"LICENSE", "go.mod", "a.go", "v2/go.mod", "v2/a.go", "sub/go.mod", "sub/s.go"} {
+		content := "// " + name + "\n"
+		tw.WriteHeader(&tar.Header{Name: "repo-abc/" + name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+
+	tests := []struct {
+		folders []string
+		want    string // files in the zip, and the go.mod they have
+	}{
+		{[]string{""}, "LICENSE a.go go.mod go.mod"},
+		{[]string{"v2", ""}, "LICENSE a.go go.mod v2/go.mod"}, // the major version folder
+		{[]string{"v3", ""}, "LICENSE a.go go.mod go.mod"},    // or the module's one
+		{[]string{"sub"}, "LICENSE go.mod s.go sub/go.mod"},
+	}
+	for _, tt := range tests {
+		gomod, fileSums, err := buildZip(context.Background(), io.Discard, bytes.NewReader(buf.Bytes()),
+			"example.com/repo", tt.folders, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fs := range fileSums {
+			names = append(names, strings.TrimPrefix(fs.name, "example.com/repo@v1.0.0/"))
+		}
+		sort.Strings(names)
+		names = append(names, strings.TrimSpace(strings.TrimPrefix(string(gomod), "// ")))
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("folders %q: got %s, want %s", tt.folders, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// The files kept in the local cache for each module@version, laid out like
+// the download cache of the go command.
+type artifacts struct {
+	zip, mod, info, ziphash string
+}
+
+func artifactsFor(lr *lookupResult, module, version string) artifacts {
+	base := path.Join(lr.conf.LocalCache, cacheName(module), "@v", cacheName(version))
+	return artifacts{
+		zip:     base + ".zip",
+		mod:     base + ".mod",
+		info:    base + ".info",
+		ziphash: base + ".ziphash",
+	}
+}
+
+// cachedArtifacts returns the artifacts of module@version when all of them
+// are in the local cache.
+func cachedArtifacts(lr *lookupResult, module, version string) (a artifacts, ok bool) {
+	if lr.conf.LocalCache == "" {
+		return
+	}
+	a = artifactsFor(lr, module, version)
+	// The zip is written last, so it marks a complete set
+	if _, err := os.Stat(a.zip); err != nil {
+		return
+	}
+	return a, true
+}
+
+// ensureArtifacts builds the module zip, go.mod, .info and zip hash of
+// module@version into the local cache if they are not there yet.  Concurrent
+// callers share a single build, which is canceled when all of them are done
+// with waiting.
+func ensureArtifacts(ctx context.Context, lr *lookupResult, ver *VersionData, module string) (artifacts, error) {
+	if a, ok := cachedArtifacts(lr, module, ver.Version); ok {
+		return a, nil
+	}
+	a := artifactsFor(lr, module, ver.Version)
+	f := join(ctx, a.zip, func(ctx context.Context, f *inflight) {
+		f.err = buildArtifacts(ctx, a, lr, ver, module)
+		f.path = a.zip
+	})
+	defer f.release()
+	_, err := f.wait(ctx)
+	return a, err
+}
+
+func buildArtifacts(ctx context.Context, a artifacts, lr *lookupResult, ver *VersionData, module string) error {
+	tgz, err := fetchArchive(ctx, lr, ver)
+	if err != nil {
+		return err
+	}
+	defer tgz.Close()
+
+	if err = os.MkdirAll(path.Dir(a.zip), 0755); err != nil {
+		return err
+	}
+
+	// Build the zip into a temporary file first, as the other artifacts are
+	// derived from it.
+	tmp, err := createTemp(path.Dir(a.zip), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer removeTemp(tmp.Name())
+	defer tmp.Close()
+	gomod, h1, err := writeCheckedZip(ctx, tmp, tgz, lr, ver, module)
+	if err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+
+	gomod = moduleFile(gomod, lr)
+	if err = ledgerCheck(lr, ledgerEntry{Module: lr.orig, Version: ver.Version, Hash: ver.Origin.Hash,
+		Sum: h1, ModSum: hashMod(gomod)}); err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(a.mod, func(fh *os.File) error {
+		_, err := fh.Write(gomod)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(a.info, func(fh *os.File) error {
+		return json.NewEncoder(fh).Encode(ver)
+	}); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(a.ziphash, func(fh *os.File) error {
+		_, err := fmt.Fprintf(fh, "h1:%s\n", h1)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	// Moving the zip in place marks the set as complete
+	if err = os.Rename(tmp.Name(), a.zip); err != nil {
+		return err
+	}
+	logOf(ctx, "cache").Debug("Cached artifacts", "module", module, "version", ver.Version, "h1", h1)
+	return nil
+}
+
+// writeCheckedZip builds the module zip into fh and reads it back to make sure
+// it matches the tarball it was built from.
+func writeCheckedZip(ctx context.Context, fh *os.File, tgz io.ReadSeeker, lr *lookupResult, ver *VersionData, module string) (gomod []byte, h1 string, err error) {
+	var fileSums []fileSum
+	gomod, fileSums, err = buildZip(ctx, fh, tgz, module, lr.folders(), ver.Version)
+	if err != nil {
+		return
+	}
+	h1 = hashFiles(fileSums)
+
+	size, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	zr, err := zip.NewReader(fh, size)
+	if err != nil {
+		return
+	}
+	got, err := hashZip(zr)
+	if err != nil {
+		return
+	}
+	if got != h1 {
+		err = fmt.Errorf("zip hash h1:%s does not match tarball h1:%s", got, h1)
+		return
+	}
+	if gomod != nil {
+		var content []byte
+		content, err = readZipFile(zr, fmt.Sprintf("%s@%s/go.mod", module, ver.Version))
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(content, gomod) {
+			err = fmt.Errorf("go.mod in zip does not match tarball")
+		}
+	}
+	return
+}
+
+func readZipFile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, zf := range zr.File {
+		if zf.Name == name {
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// readZipHash returns the h1: hash of the module zip recorded in the cache.
+func readZipHash(a artifacts) (string, error) {
+	content, err := os.ReadFile(a.ziphash)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(content)), "h1:"), nil
+}
+
+// serveArtifact replies with a cached file, handling range and conditional
+// requests.
+func serveArtifact(w http.ResponseWriter, r *http.Request, file, contentType string) bool {
+	fh, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	stat, err := fh.Stat()
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, path.Base(file), stat.ModTime(), fh)
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnsureArtifacts(t *testing.T) {
+	srv := newArchiveServer(t, testTarball(t, 1000, 2000))
+	close(srv.resume)
+	dir := t.TempDir()
+	lr := testLookup(t, srv.URL)
+	lr.orig, lr.conf = "example.com/grp/repo", &yamlParse{LocalCache: dir}
+	ver := &VersionData{Version: "v1.0.0", cacheDir: filepath.Join(dir, "tgz")}
+	ver.Origin.Hash = strings.Repeat("c", 40)
+	ver.cachePath = filepath.Join(ver.cacheDir, "v1.0.020230301120000-"+ver.Origin.Hash+".tgz")
+	os.MkdirAll(ver.cacheDir, 0755)
+
+	if _, ok := cachedArtifacts(lr, lr.orig, ver.Version); ok {
+		t.Fatal("artifacts cached before they are built")
+	}
+	a, err := ensureArtifacts(context.Background(), lr, ver, lr.orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cachedArtifacts(lr, lr.orig, ver.Version); !ok {
+		t.Fatal("artifacts not cached")
+	}
+
+	// The zip matches its recorded hash, the go.mod and .info the version
+	zr, err := zip.OpenReader(a.zip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	h1, err := hashZip(&zr.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded, err := readZipHash(a); err != nil || recorded != h1 {
+		t.Errorf("zip hash h1:%s recorded, the zip has h1:%s (%v)", recorded, h1, err)
+	}
+	var names []string
+	for _, zf := range zr.File {
+		names = append(names, zf.Name)
+	}
+	if got := strings.Join(names, " "); got != "example.com/grp/repo@v1.0.0/file example.com/grp/repo@v1.0.0/filex" {
+		t.Errorf("zip has %s", got)
+	}
+	if mod, _ := os.ReadFile(a.mod); string(mod) != "module example.com/grp/repo\n" {
+		t.Errorf("go.mod is %q", mod)
+	}
+	var info VersionData
+	if content, _ := os.ReadFile(a.info); json.Unmarshal(content, &info) != nil || info.Version != "v1.0.0" || info.Origin.Hash != ver.Origin.Hash {
+		t.Errorf(".info is %s", content)
+	}
+
+	// Built once, then served with range requests
+	if _, err := ensureArtifacts(context.Background(), lr, ver, lr.orig); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	if srv.calls != 1 {
+		t.Errorf("%d downloads, want 1", srv.calls)
+	}
+	srv.mu.Unlock()
+	r := httptest.NewRequest("GET", "/example.com/grp/repo/@v/v1.0.0.zip", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	w := httptest.NewRecorder()
+	if !serveArtifact(w, r, a.zip, "application/zip") || w.Code != http.StatusPartialContent || w.Body.String() != "PK\x03\x04" {
+		t.Errorf("range of the zip: %d %q", w.Code, w.Body.String())
+	}
+}
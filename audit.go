@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An audit record is written for every request, answering which client
+// pulled which version of a module and when.
+type auditRecord struct {
+	Time      string `json:"time"`
+	RequestID string `json:"request_id"`
+	ClientIP  string `json:"client_ip"`
+	Subject   string `json:"cert_subject,omitempty"`
+	User      string `json:"user,omitempty"`
+	Kind      string `json:"kind"`
+	Module    string `json:"module,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Resolved  string `json:"resolved,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Cache     string `json:"cache,omitempty"` // hit or miss
+	Bytes     int64  `json:"bytes"`
+	Status    int    `json:"status"`
+	Duration  string `json:"duration"`
+
+	id *identity
+}
+
+type auditKey struct{}
+
+var auditLogger = newLogger("audit")
+
+var audit struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // bytes
+	backups int
+	file    *os.File
+	size    int64
+	syslog  *syslog.Writer
+	enabled bool
+}
+
+func loadAudit(data *yamlParse) {
+	audit.path, audit.maxSize, audit.backups = data.AuditLog, int64(data.AuditLogMaxSize)<<20, data.AuditLogBackups
+	if data.AuditLog != "" {
+		if err := openAuditLog(); err != nil {
+			log.Fatal("Error opening audit log: ", err)
+		}
+		audit.enabled = true
+	}
+	if data.AuditSyslog != "" {
+		var w *syslog.Writer
+		var err error
+		if data.AuditSyslog == "local" {
+			w, err = syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "goproxy")
+		} else {
+			u, perr := url.Parse(data.AuditSyslog)
+			if perr != nil {
+				log.Fatal("Error parsing audit-syslog: ", perr)
+			}
+			w, err = syslog.Dial(u.Scheme, u.Host, syslog.LOG_INFO|syslog.LOG_AUTH, "goproxy")
+		}
+		if err != nil {
+			log.Fatal("Error connecting to syslog: ", err)
+		}
+		audit.syslog = w
+		audit.enabled = true
+	}
+}
+
+func openAuditLog() error {
+	fh, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	stat, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	audit.file, audit.size = fh, stat.Size()
+	return nil
+}
+
+// rotateAuditLog shifts audit.log.N to audit.log.N+1, dropping the oldest,
+// and starts a new log.
+func rotateAuditLog() error {
+	audit.file.Close()
+	backups := audit.backups
+	if backups <= 0 {
+		backups = 5
+	}
+	os.Remove(fmt.Sprintf("%s.%d", audit.path, backups))
+	for i := backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", audit.path, i), fmt.Sprintf("%s.%d", audit.path, i+1))
+	}
+	os.Rename(audit.path, audit.path+".1")
+	return openAuditLog()
+}
+
+func writeAudit(rec *auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if audit.file != nil {
+		if audit.maxSize > 0 && audit.size+int64(len(line))+1 > audit.maxSize {
+			if err := rotateAuditLog(); err != nil {
+				auditLogger.Error("Error rotating audit log", "err", err)
+			}
+		}
+		if audit.file != nil {
+			n, err := audit.file.Write(append(line, '\n'))
+			audit.size += int64(n)
+			if err != nil {
+				auditLogger.Error("Error writing audit log", "err", err)
+			}
+		}
+	}
+	if audit.syslog != nil {
+		if err := audit.syslog.Info(string(line)); err != nil {
+			auditLogger.Error("Error writing audit syslog", "err", err)
+		}
+	}
+}
+
+// auditOf returns the audit record of the request, or a throw away one when
+// auditing is off.
+func auditOf(r *http.Request) *auditRecord {
+	if rec, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		return rec
+	}
+	return &auditRecord{}
+}
+
+// identityOf returns the identities the client presented with the request.
+func identityOf(r *http.Request) *identity {
+	if rec := auditOf(r); rec.id != nil {
+		return rec.id
+	}
+	return newIdentity(r)
+}
+
+// version notes what the requested version resolved to.
+func (rec *auditRecord) version(ver *VersionData) {
+	rec.Resolved, rec.Hash = ver.Version, ver.Origin.Hash
+	if ver.Origin.VCS == "cache" {
+		rec.Cache = "hit"
+	}
+}
+
+// cache notes whether the reply came from the local cache.
+func (rec *auditRecord) cache(hit bool) {
+	if hit {
+		rec.Cache = "hit"
+	} else {
+		rec.Cache = "miss"
+	}
+}
+
+// requestKind splits a proxy request path into the kind of request, the
+// module and the version asked for.
+func requestKind(p string) (kind, module, version string) {
+	p = strings.TrimPrefix(p, "/")
+	if strings.HasPrefix(p, "lookup/") {
+		if i := strings.LastIndex(p, "@"); i > len("lookup/") {
+			return "lookup", p[len("lookup/"):i], p[i+1:]
+		}
+		return "other", "", ""
+	}
+	if strings.HasSuffix(p, "/@latest") {
+		return "latest", strings.TrimSuffix(p, "/@latest"), ""
+	}
+	if i := strings.Index(p, "/@v/"); i > 0 {
+		module, file := p[:i], p[i+len("/@v/"):]
+		if file == "list" {
+			return "list", module, ""
+		}
+		// The kind labels the metrics, so only the known ones are kept
+		if dot := strings.LastIndex(file, "."); dot > 0 {
+			switch ext := file[dot+1:]; ext {
+			case "info", "mod", "zip", "sum":
+				return ext, module, file[:dot]
+			}
+		}
+		return "other", module, ""
+	}
+	return "other", "", ""
+}
+
+// auditWriter counts what is sent to the client.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// auditLog is the outermost middleware, recording every request in the
+// metrics and the audit log once the reply has been sent.  The request gets
+// an id, which the log records made for it carry.
+func auditLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &auditRecord{Time: start.UTC().Format(time.RFC3339Nano), id: newIdentity(r),
+			RequestID: requestID(r.Header.Get("X-Request-ID"))}
+		rec.ClientIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+		rec.Kind, rec.Module, rec.Version = requestKind(r.URL.Path)
+		if module, err := unescapePath(rec.Module); err == nil {
+			rec.Module = module
+		}
+		w.Header().Set("X-Request-ID", rec.RequestID)
+		l := newLogger("http").With("request_id", rec.RequestID)
+		l.Debug("Request", "method", r.Method, "uri", r.RequestURI, "client", r.RemoteAddr)
+
+		ctx := context.WithValue(r.Context(), auditKey{}, rec)
+		aw := &auditWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(ctx, loggerKey{}, l)))
+
+		rec.Status, rec.Bytes = aw.status, aw.bytes
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		l.Debug("Replied", "status", rec.Status, "bytes", rec.Bytes, "duration", elapsed)
+		observeRequest(rec, elapsed)
+		if !audit.enabled {
+			return
+		}
+
+		rec.Duration = elapsed.String()
+		if rec.id.cert != nil {
+			rec.Subject = certPKIXString(rec.id.cert.Subject, ",")
+		}
+		rec.User = rec.id.user()
+		writeAudit(rec)
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestRequestKind(t *testing.T) {
+	tests := []struct {
+		path                  string
+		kind, module, version string
+	}{
+		{"/gitlab.com/grp/repo/@v/list", "list", "gitlab.com/grp/repo", ""},
+		{"/gitlab.com/grp/repo/@v/v1.0.0.info", "info", "gitlab.com/grp/repo", "v1.0.0"},
+		{"/gitlab.com/grp/repo/@v/v1.0.0.mod", "mod", "gitlab.com/grp/repo", "v1.0.0"},
+		{"/gitlab.com/grp/repo/@v/v1.0.0.zip", "zip", "gitlab.com/grp/repo", "v1.0.0"},
+		{"/gitlab.com/grp/repo/@v/v1.0.0.sum", "sum", "gitlab.com/grp/repo", "v1.0.0"},
+		{"/gitlab.com/grp/repo/@latest", "latest", "gitlab.com/grp/repo", ""},
+		{"/lookup/gitlab.com/grp/repo@v1.0.0", "lookup", "gitlab.com/grp/repo", "v1.0.0"},
+		{"/github.com/!azure/sdk/@v/v0.1.0-rc.1.info", "info", "github.com/!azure/sdk", "v0.1.0-rc.1"},
+
+		// Anything else is other, whatever the client sends
+		{"/gitlab.com/grp/repo/@v/v1.0.0.exe", "other", "gitlab.com/grp/repo", ""},
+		{"/gitlab.com/grp/repo/@v/v1.0.0.zip-1234", "other", "gitlab.com/grp/repo", ""},
+		{"/gitlab.com/grp/repo/@v/noext", "other", "gitlab.com/grp/repo", ""},
+		{"/gitlab.com/grp/repo/@v/.info", "other", "gitlab.com/grp/repo", ""},
+		{"/lookup/", "other", "", ""},
+		{"/lookup/@v1.0.0", "other", "", ""},
+		{"/metrics", "other", "", ""},
+		{"/", "other", "", ""},
+	}
+	for _, tt := range tests {
+		kind, module, version := requestKind(tt.path)
+		if kind != tt.kind || module != tt.module || version != tt.version {
+			t.Errorf("requestKind(%q) = %q, %q, %q, want %q, %q, %q",
+				tt.path, kind, module, version, tt.kind, tt.module, tt.version)
+		}
+	}
+}
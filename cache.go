@@ -0,0 +1,375 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// An inflight operation on the cache.  All requests for the same key share
+// one of these and read the resulting file once done is closed, or follow it
+// while it is written.
+type inflight struct {
+	key    string
+	done   chan struct{}
+	cancel context.CancelFunc // stops the operation when no one waits for it
+	path   string             // where the result can be read from once done
+	temp   bool               // the file is not in the cache and is removed after the last reader
+	refs   int
+	err    error
+
+	mu       sync.Mutex
+	partial  string        // the file being written, until it is complete
+	written  int64         // bytes in the partial file
+	progress chan struct{} // closed, and replaced, when the partial file grows
+}
+
+var (
+	fetchMu  sync.Mutex
+	fetching = make(map[string]*inflight)
+	fetches  sync.WaitGroup // the operations running, canceled ones included
+)
+
+// join attaches to the inflight operation for key, starting fn in the
+// background when there is none yet.  The operation is not tied to the
+// request starting it, besides logging with its id, it runs until
+// -fetch-timeout or until every caller released it.  Callers must wait for
+// the result and then release their reference.
+func join(ctx context.Context, key string, fn func(context.Context, *inflight)) *inflight {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+	f, ok := fetching[key]
+	if !ok {
+		ctx, cancel := context.WithTimeout(context.WithValue(baseCtx, loggerKey{}, logOf(ctx, "")), *fetchTimeout)
+		f = &inflight{key: key, done: make(chan struct{}), cancel: cancel, progress: make(chan struct{})}
+		fetching[key] = f
+		fetches.Add(1)
+		go func() {
+			defer func() {
+				cancel()
+				fetchMu.Lock()
+				if fetching[key] == f {
+					delete(fetching, key)
+				}
+				if f.refs == 0 && f.temp && f.path != "" { // abandoned just as it finished
+					removeTemp(f.path)
+				}
+				close(f.done)
+				fetchMu.Unlock()
+				fetches.Done()
+			}()
+			fn(ctx, f)
+		}()
+	} else {
+		logOf(ctx, "cache").Debug("Waiting on inflight operation", "key", key)
+	}
+	f.refs++
+	return f
+}
+
+// wait blocks until the operation has finished or ctx is done.
+func (f *inflight) wait(ctx context.Context) (string, error) {
+	select {
+	case <-f.done:
+		return f.path, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// release drops a reference to the operation, removing the temporary file
+// when no readers remain.  On Linux the open handles stay valid after the
+// removal.  An operation still running with no one left waiting is canceled,
+// and the next request for the key starts over.
+func (f *inflight) release() {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+	f.refs--
+	if f.refs > 0 {
+		return
+	}
+	select {
+	case <-f.done:
+		if f.temp && f.path != "" {
+			removeTemp(f.path)
+		}
+	default:
+		newLogger("cache").Debug("Canceling abandoned operation", "key", f.key)
+		f.cancel()
+		if fetching[f.key] == f {
+			delete(fetching, f.key)
+		}
+	}
+}
+
+// fetchArchive returns an open handle to the upstream tarball of the given
+// version.  When the tarball is in the local cache it is used directly,
+// otherwise concurrent callers asking for the same module@version are
+// coalesced into a single upstream download, which they all read as it
+// arrives.
+func fetchArchive(ctx context.Context, lr *lookupResult, ver *VersionData) (io.ReadSeekCloser, error) {
+	if ver.cachePath != "" {
+		if fh, err := os.Open(ver.cachePath); err == nil {
+			return fh, nil
+		}
+	}
+
+	key := ver.cachePath
+	if key == "" {
+		key = lr.baseGroupRepo + "@" + ver.Origin.Hash
+	}
+
+	f := join(ctx, key, func(ctx context.Context, f *inflight) { f.fetch(ctx, lr, ver) })
+	for {
+		f.mu.Lock()
+		partial, progress := f.partial, f.progress
+		if partial != "" {
+			// Opened before it can be moved or removed
+			fh, err := os.Open(partial)
+			f.mu.Unlock()
+			if err != nil {
+				f.release()
+				return nil, err
+			}
+			return &follower{ctx: ctx, f: f, fh: fh}, nil
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-progress:
+		case <-f.done:
+			defer f.release()
+			if f.err != nil {
+				return nil, f.err
+			}
+			return os.Open(f.path)
+		case <-ctx.Done():
+			f.release()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// grow notes that n more bytes are in the partial file.
+func (f *inflight) grow(n int) {
+	f.mu.Lock()
+	f.written += int64(n)
+	close(f.progress)
+	f.progress = make(chan struct{})
+	f.mu.Unlock()
+}
+
+// follower reads the partial file of an operation as it is written, waiting
+// for more at its end until the operation is done.  It holds a reference to
+// the operation until closed.
+type follower struct {
+	ctx context.Context
+	f   *inflight
+	fh  *os.File
+	off int64
+}
+
+func (r *follower) Read(p []byte) (int, error) {
+	for {
+		r.f.mu.Lock()
+		written, progress := r.f.written, r.f.progress
+		r.f.mu.Unlock()
+		if r.off < written {
+			if int64(len(p)) > written-r.off {
+				p = p[:written-r.off]
+			}
+			n, err := r.fh.ReadAt(p, r.off)
+			r.off += int64(n)
+			if n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+
+		select {
+		case <-progress:
+		case <-r.f.done:
+			if r.f.err != nil {
+				return 0, r.f.err
+			}
+			r.f.mu.Lock()
+			written = r.f.written
+			r.f.mu.Unlock()
+			if r.off >= written {
+				return 0, io.EOF
+			}
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// Seek only goes back or forward from the start or the current offset, as
+// the end is not known yet.
+func (r *follower) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	default:
+		return 0, errors.New("seeking from the end of a download")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *follower) Close() error {
+	err := r.fh.Close()
+	r.f.release()
+	return err
+}
+
+// growWriter counts what is written into the partial file of an operation.
+type growWriter struct {
+	fh *os.File
+	f  *inflight
+}
+
+func (w growWriter) Write(p []byte) (int, error) {
+	n, err := w.fh.Write(p)
+	if n > 0 {
+		w.f.grow(n)
+	}
+	return n, err
+}
+
+// fetch downloads the tarball into a temporary file, validates it and moves
+// it into the cache.  Partial downloads never appear under the cache name.
+func (f *inflight) fetch(ctx context.Context, lr *lookupResult, ver *VersionData) {
+	dir := ver.cacheDir
+	if ver.cachePath == "" {
+		dir = ""
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		logOf(ctx, "cache").Warn("Error creating cache dir", "err", err)
+		dir = ""
+	}
+
+	fh, err := createTemp(dir, tempPrefix)
+	if err != nil {
+		f.err = err
+		return
+	}
+	tmp := fh.Name()
+	f.mu.Lock()
+	f.partial = tmp
+	f.mu.Unlock()
+	f.grow(0) // the readers may start
+	defer func() {
+		if f.err != nil || !f.temp {
+			removeTemp(tmp)
+		}
+	}()
+
+	err = download(ctx, growWriter{fh, f}, lr, ver)
+	// Later readers wait for the result, as the file is to be moved
+	f.mu.Lock()
+	f.partial = ""
+	f.mu.Unlock()
+	if err != nil && ctx.Err() != nil {
+		abandoned(ctx, "fetch")
+		err = fmt.Errorf("fetching archive: %w", ctx.Err())
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = validateArchive(tmp)
+	}
+	if err != nil {
+		f.err = err
+		return
+	}
+
+	if dir == "" {
+		f.path, f.temp = tmp, true
+		return
+	}
+	if err = os.Rename(tmp, ver.cachePath); err != nil {
+		f.err = err
+		return
+	}
+	f.path = ver.cachePath
+	logOf(ctx, "cache").Debug("Cached archive", "file", path.Base(ver.cachePath), "repo", lr.baseGroupRepo)
+}
+
+// Temporary files in the cache start with this prefix so they are never
+// mistaken for cache entries.
+const tempPrefix = ".goproxy-tmp-*"
+
+// writeFileAtomic writes a cache file by way of a temporary file, so readers
+// either see the complete file or none at all.
+func writeFileAtomic(name string, write func(*os.File) error) error {
+	fh, err := createTemp(path.Dir(name), tempPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := fh.Name()
+	defer removeTemp(tmp)
+	err = write(fh)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	return err
+}
+
+// download copies the upstream tarball into w.
+func download(ctx context.Context, w io.Writer, lr *lookupResult, ver *VersionData) error {
+	rc, err := openArchive(ctx, lr, ver)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+var errNotTGZ = errors.New("archive is not TGZ")
+
+// validateArchive reads the whole file to make sure it is a complete gzipped
+// tar stream before it is trusted as a cache entry.
+func validateArchive(file string) error {
+	fh, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		return errNotTGZ
+	}
+	tr := tar.NewReader(gz)
+	for {
+		_, err = tr.Next()
+		if err == io.EOF {
+			// Drain the trailer so the gzip checksum is verified
+			_, err = io.Copy(io.Discard, gz)
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("invalid archive: %w", err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// testTarball makes a tarball with files of the given sizes.
+func testTarball(t *testing.T, sizes ...int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for i, size := range sizes {
+		name := "repo-abc/file" + strings.Repeat("x", i)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(size), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(bytes.Repeat([]byte{byte('a' + i)}, size))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// archiveServer serves the tarball in two halves, the second one once
+// resume is closed.  Calls counts the downloads.
+type archiveServer struct {
+	*httptest.Server
+	tgz    []byte
+	resume chan struct{}
+	mu     sync.Mutex
+	calls  int
+}
+
+func newArchiveServer(t *testing.T, tgz []byte) *archiveServer {
+	s := &archiveServer{tgz: tgz, resume: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/repository/archive.tar.gz") {
+			return // go-gitlab asks for the rate limit first
+		}
+		s.mu.Lock()
+		s.calls++
+		s.mu.Unlock()
+		half := len(s.tgz) / 2
+		w.Write(s.tgz[:half])
+		w.(http.Flusher).Flush()
+		select {
+		case <-s.resume:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(s.tgz[half:])
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testLookup(t *testing.T, url string) *lookupResult {
+	client, err := gitlab.NewClient("", gitlab.WithBaseURL(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lookupResult{git: client, groupRepo: "grp/repo", baseGroupRepo: "example.com/grp/repo"}
+}
+
+func TestFetchArchiveShared(t *testing.T) {
+	tgz := testTarball(t, 64<<10, 300<<10)
+	srv := newArchiveServer(t, tgz)
+	lr := testLookup(t, srv.URL)
+	dir := t.TempDir()
+	ver := &VersionData{cacheDir: dir, cachePath: filepath.Join(dir, "v1.0.0"+"20230301120000-"+strings.Repeat("a", 40)+".tgz")}
+	ver.Origin.Hash = strings.Repeat("a", 40)
+
+	// Both readers get the first half before the rest is sent
+	var readers []io.ReadSeekCloser
+	for i := 0; i < 2; i++ {
+		r, err := fetchArchive(context.Background(), lr, ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		head := make([]byte, len(tgz)/2)
+		if _, err := io.ReadFull(r, head); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(head, tgz[:len(head)]) {
+			t.Errorf("reader %d: first half differs", i+1)
+		}
+		readers = append(readers, r)
+	}
+	if _, err := os.Stat(ver.cachePath); err == nil {
+		t.Error("partial download in the cache")
+	}
+	close(srv.resume)
+
+	for i, r := range readers {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reader %d: %v", i+1, err)
+		}
+		if !bytes.Equal(got, tgz) {
+			t.Errorf("reader %d: got %d bytes, want %d", i+1, len(got), len(tgz))
+		}
+	}
+	srv.mu.Lock()
+	if srv.calls != 1 {
+		t.Errorf("%d downloads, want 1", srv.calls)
+	}
+	srv.mu.Unlock()
+
+	// Moved into the cache once validated, without temporary files left
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(ver.cachePath) {
+		t.Errorf("cache dir has %v, want only %s", entries, filepath.Base(ver.cachePath))
+	}
+}
+
+func TestFetchArchiveInvalid(t *testing.T) {
+	tgz := testTarball(t, 64<<10)
+	srv := newArchiveServer(t, tgz[:len(tgz)-100]) // cut short
+	close(srv.resume)
+	lr := testLookup(t, srv.URL)
+	dir := t.TempDir()
+	ver := &VersionData{cacheDir: dir, cachePath: filepath.Join(dir, "20230301120000-"+strings.Repeat("b", 40)+".tgz")}
+	ver.Origin.Hash = strings.Repeat("b", 40)
+
+	r, err := fetchArchive(context.Background(), lr, ver)
+	if err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+	}
+	if err == nil {
+		t.Error("truncated archive read without error")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("cache dir has %v after a failed download", entries)
+	}
+}
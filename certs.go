@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The TLS settings of the server.
+type yamlTLS struct {
+	MinVersion string   `yaml:"min-version"` // 1.2 (default) or 1.3
+	Ciphers    []string `yaml:"ciphers"`     // TLS 1.2 suites, the TLS 1.3 ones are always on
+
+	// More certificate and key pairs besides -cert, picked by the name the
+	// client asks for (SNI)
+	Certificates []yamlCertificate `yaml:"certificates"`
+
+	// Warn when a certificate expires within this time (default 14 days)
+	ExpiryWarning time.Duration `yaml:"expiry-warning"`
+}
+
+type yamlCertificate struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"` // when not in the cert file
+}
+
+// The forward secret AEAD suites, for TLS 1.2 clients.
+var defaultCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+const certCheckInterval = 30 * time.Second
+
+// policy returns the minimum version and the cipher suites.
+func (t *yamlTLS) policy() (uint16, []uint16, error) {
+	version := uint16(tls.VersionTLS12)
+	switch t.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		version = tls.VersionTLS13
+	default:
+		return 0, nil, fmt.Errorf("unknown tls min-version %q, expected 1.2 or 1.3", t.MinVersion)
+	}
+	if len(t.Ciphers) == 0 {
+		return version, defaultCiphers, nil
+	}
+	var ciphers []uint16
+	for _, name := range t.Ciphers {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ciphers, found = append(ciphers, suite.ID), true
+				break
+			}
+		}
+		if !found {
+			return 0, nil, fmt.Errorf("unknown or insecure tls cipher %q", name)
+		}
+	}
+	return version, ciphers, nil
+}
+
+// setTLSPolicy applies the minimum version and ciphers of the config.
+func setTLSPolicy(t *yamlTLS) {
+	version, ciphers, _ := t.policy()
+	tlsConfig.MinVersion, tlsConfig.CipherSuites = version, ciphers
+}
+
+// A certificate and key pair, read in again when the files change.
+type certPair struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time // of the newest file when read in
+}
+
+var serverCerts struct {
+	sync.Mutex
+	pairs []*certPair // the one of -cert first
+	warn  time.Duration
+}
+
+func (p *certPair) modTime() (mod time.Time) {
+	for _, f := range []string{p.certFile, p.keyFile} {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(mod) {
+			mod = info.ModTime()
+		}
+	}
+	return
+}
+
+// load reads in the pair and makes sure the certificate is trusted.
+func (p *certPair) load() error {
+	mod := p.modTime()
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %w", p.certFile, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("loading certificate %s: %w", p.certFile, err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(c)
+		}
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: caCertPool, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("unable to verify certificate %s with the provided CA: %w", p.certFile, err)
+	}
+	tlsLogger.Debug("Loaded certificate", "file", p.certFile, "subject", certPKIXString(cert.Leaf.Subject, ","),
+		"issuer", certPKIXString(cert.Leaf.Issuer, ","))
+
+	p.mu.Lock()
+	p.cert, p.modified = &cert, mod
+	p.mu.Unlock()
+
+	left := time.Until(cert.Leaf.NotAfter)
+	metricCertExpiry.set(left.Seconds(), p.certFile)
+	serverCerts.Lock()
+	warn := serverCerts.warn
+	serverCerts.Unlock()
+	if warn <= 0 {
+		warn = 14 * 24 * time.Hour
+	}
+	if left < warn {
+		tlsLogger.Warn("Certificate expires soon", "file", p.certFile, "names", strings.Join(cert.Leaf.DNSNames, ","),
+			"in", left.Round(time.Hour), "expiry", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (p *certPair) get() *tls.Certificate {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cert
+}
+
+// changed tells whether the files were modified since read in.
+func (p *certPair) changed() bool {
+	mod := p.modTime()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !mod.IsZero() && !mod.Equal(p.modified)
+}
+
+// getCertificate picks the certificate for the name the client asks for, or
+// the first one.
+func getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverCerts.Lock()
+	pairs := serverCerts.pairs
+	serverCerts.Unlock()
+	var first *tls.Certificate
+	for _, p := range pairs {
+		cert := p.get()
+		if cert == nil {
+			continue
+		}
+		if first == nil {
+			first = cert
+		}
+		if hello.ServerName != "" && hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	if first == nil {
+		return nil, errors.New("no server certificate")
+	}
+	return first, nil
+}
+
+// loadCertificates sets the certificates of the config besides the one of
+// -cert, keeping the ones read in before for the same files.
+func loadCertificates(data *yamlParse) error {
+	serverCerts.Lock()
+	old := serverCerts.pairs
+	serverCerts.warn = data.TLS.ExpiryWarning
+	serverCerts.Unlock()
+
+	var pairs []*certPair
+	if len(old) > 0 && *certFile != "" {
+		pairs = append(pairs, old[0])
+	}
+next:
+	for _, c := range data.TLS.Certificates {
+		key := c.Key
+		if key == "" {
+			key = c.Cert
+		}
+		for _, p := range old {
+			if p.certFile == c.Cert && p.keyFile == key {
+				pairs = append(pairs, p)
+				continue next
+			}
+		}
+		p := &certPair{certFile: c.Cert, keyFile: key}
+		if err := p.load(); err != nil {
+			return err
+		}
+		pairs = append(pairs, p)
+	}
+
+	serverCerts.Lock()
+	serverCerts.pairs = pairs
+	serverCerts.Unlock()
+	return nil
+}
+
+// watchCertificates reads in the certificates again when their files change,
+// so rotated certificates are used without a restart.  A pair which fails to
+// load, ie: the key is not written yet, is tried again.
+func watchCertificates() {
+	go func() {
+		for range time.Tick(certCheckInterval) {
+			serverCerts.Lock()
+			pairs := serverCerts.pairs
+			serverCerts.Unlock()
+			for _, p := range pairs {
+				if !p.changed() {
+					continue
+				}
+				if err := p.load(); err != nil {
+					tlsLogger.Error("Error reloading certificate, keeping the current one", "err", err)
+				} else {
+					tlsLogger.Info("Reloaded certificate", "file", p.certFile)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(60 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue writes a certificate for the name with its key into file, and
+// returns its serial number.
+func (ca *testCA) issue(t *testing.T, file, name string) int64 {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour), // no expiry warning
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	out = append(out, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	if err := os.WriteFile(file, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ca.serial
+}
+
+func TestServerCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	savedPool := caCertPool
+	caCertPool = pool
+	t.Cleanup(func() {
+		caCertPool = savedPool
+		serverCerts.pairs, serverCerts.warn = nil, 0
+	})
+
+	dir := t.TempDir()
+	fileA, fileB := filepath.Join(dir, "a.pem"), filepath.Join(dir, "b.pem")
+	serialA := ca.issue(t, fileA, "a.example.com")
+	serialB := ca.issue(t, fileB, "b.example.com")
+	data := &yamlParse{TLS: yamlTLS{Certificates: []yamlCertificate{{Cert: fileA}, {Cert: fileB}}}}
+	if err := loadCertificates(data); err != nil {
+		t.Fatal(err)
+	}
+
+	served := func(name string) int64 {
+		t.Helper()
+		cert, err := getCertificate(&tls.ClientHelloInfo{
+			ServerName:        name,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.SerialNumber.Int64()
+	}
+	check := func(step string, a, b int64) {
+		t.Helper()
+		for _, tt := range []struct {
+			name string
+			want int64
+		}{{"a.example.com", a}, {"b.example.com", b}, {"other.example.com", a}, {"", a}} {
+			if got := served(tt.name); got != tt.want {
+				t.Errorf("%s: certificate %d served for %q, want %d", step, got, tt.name, tt.want)
+			}
+		}
+	}
+	check("loaded", serialA, serialB)
+
+	// A rotated certificate is read in again
+	serialB = ca.issue(t, fileB, "b.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fileB, later, later)
+	reloadChanged(t)
+	check("rotated", serialA, serialB)
+
+	// A broken one is not, the current one is kept
+	os.WriteFile(fileA, []byte("not yet"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(fileA, later, later)
+	reloadChanged(t)
+	check("broken", serialA, serialB)
+
+	// A config reload keeps the pairs read in
+	pairs := serverCerts.pairs
+	if err := loadCertificates(data); err != nil {
+		t.Fatal(err)
+	}
+	if serverCerts.pairs[0] != pairs[0] || serverCerts.pairs[1] != pairs[1] {
+		t.Error("certificates read in again on a config reload")
+	}
+}
+
+// reloadChanged does what watchCertificates does on each tick.
+func reloadChanged(t *testing.T) {
+	t.Helper()
+	for _, p := range serverCerts.pairs {
+		if p.changed() {
+			if err := p.load(); err != nil {
+				t.Log(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// An expected mapping of a module, checked whenever the config is loaded.
+type yamlTest struct {
+	Module   string `yaml:"module"`
+	Repo     string `yaml:"repo"`      // expected base/group/repo, ie: gitlab.com/pkg-a
+	Path     string `yaml:"path"`      // expected folder in the repo
+	GitURL   string `yaml:"git-url"`   // expected git server
+	NotFound bool   `yaml:"not-found"` // the module must not be served
+	Rule     string `yaml:"rule"`      // name of the rule expected to be used
+}
+
+// runTests checks the lookups against the tests of the config.
+func (data *yamlParse) runTests() error {
+	var failed []string
+	for _, t := range data.Tests {
+		lr, ok := data.Lookup(baseCtx, t.Module)
+		if ok {
+			lr.probeGroups(baseCtx)
+		}
+		var got []string
+		switch {
+		case t.NotFound:
+			if ok {
+				got = append(got, "found "+lr.baseGroupRepo)
+			}
+		case !ok:
+			got = append(got, "not found")
+		default:
+			if t.Repo != "" && lr.baseGroupRepo != t.Repo {
+				got = append(got, fmt.Sprintf("repo %q, expected %q", lr.baseGroupRepo, t.Repo))
+			}
+			if t.Path != "" && lr.cleanPath != t.Path {
+				got = append(got, fmt.Sprintf("path %q, expected %q", lr.cleanPath, t.Path))
+			}
+			if t.GitURL != "" && lr.gitURL != t.GitURL {
+				got = append(got, fmt.Sprintf("git-url %q, expected %q", lr.gitURL, t.GitURL))
+			}
+			if t.Rule != "" && lr.rule != t.Rule {
+				got = append(got, fmt.Sprintf("rule %q, expected %q", lr.rule, t.Rule))
+			}
+		}
+		if len(got) > 0 {
+			failed = append(failed, t.Module+": "+strings.Join(got, ", "))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("config tests failed:\n  " + strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+// checkConfig implements the check-config command, reporting the problems
+// found in the config file.  It returns the exit code.
+func checkConfig() int {
+	problems := 0
+	report := func(format string, a ...interface{}) {
+		fmt.Printf(format+"\n", a...)
+		problems++
+	}
+
+	raw, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err = dec.Decode(&yamlParse{}); err != nil {
+		report("%v", err)
+	}
+
+	c, err := parseConfig(*configFile)
+	if err != nil {
+		report("%v", err)
+		return 1
+	}
+
+	if c.GitLabURL == "" && (c.GitLabToken != nil || len(c.GitTokens) > 0 || c.GitLabProvider != "" || c.GitAuth != "") {
+		report("git-token(s), git-credential-helper, git-provider or git-auth set without a git-url")
+	}
+	for i := range c.Regexp {
+		elm := &c.Regexp[i]
+		if elm.GitLabURL == "" && (elm.GitLabToken != nil || len(elm.GitTokens) > 0 || elm.GitLabProvider != "" || elm.GitAuth != "") {
+			report("rule %s: git-token(s), git-credential-helper, git-provider or git-auth set without a git-url", elm.name())
+		}
+		if elm.GitLabURL == "" && c.GitLabURL == "" {
+			report("rule %s: no git-url for the rule and no default git-url", elm.name())
+		}
+		if j := shadowedBy(c.Regexp, i); j >= 0 {
+			report("rule %s is shadowed by %s", elm.name(), c.Regexp[j].name())
+		}
+	}
+
+	for _, cert := range c.TLS.Certificates {
+		key := cert.Key
+		if key == "" {
+			key = cert.Cert
+		}
+		if err := (&certPair{certFile: cert.Cert, keyFile: key}).load(); err != nil {
+			report("%v", err)
+		}
+	}
+
+	for _, l := range c.Listeners {
+		if l.TLS && *certFile == "" && len(c.TLS.Certificates) == 0 {
+			report("listener %s: tls without -cert or tls certificates", l.Address)
+		}
+	}
+
+	for _, p := range probesFor(c) {
+		if res := p.run(); !res.OK {
+			report("%s %s: %s", p.name, p.url, res.Error)
+		} else {
+			configLogger.Debug("Checked backend", "name", p.name, "url", p.url)
+		}
+	}
+
+	if problems > 0 {
+		return 1
+	}
+	fmt.Println("config ok:", len(c.Modules), "modules,", len(c.Regexp), "rules,", len(c.Tests), "tests")
+	return 0
+}
+
+// shadowedBy returns the index of a rule tried before the rule at i which
+// matches every module the rule at i can match, or -1 when there is none found.
+func shadowedBy(rules []yamlMatchReplace, i int) int {
+	rule := &rules[i]
+	expr, anchored := trimCaret(rule.Match)
+	var prefix string
+	complete := false
+	if rule.regexp != nil {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return -1
+		}
+		// Everything the rule matches contains the prefix
+		prefix, complete = re.LiteralPrefix()
+	}
+	for j := range rules {
+		earlier := &rules[j]
+		if j == i || earlier.Priority < rule.Priority || (earlier.Priority == rule.Priority && j > i) {
+			continue
+		}
+		if earlier.regexp == nil {
+			// A prefix rule is tried before regexp rules of the same priority
+			if rule.regexp == nil && earlier.Prefix == rule.Prefix {
+				return j
+			}
+			if rule.regexp != nil && anchored && (strings.HasPrefix(prefix, earlier.Prefix+"/") ||
+				(complete && prefix == earlier.Prefix)) {
+				return j
+			}
+			continue
+		}
+		if rule.regexp == nil {
+			if earlier.Priority > rule.Priority && earlier.regexp.MatchString(rule.Prefix) && !hasAnchors(earlier.Match) {
+				return j
+			}
+			continue
+		}
+		if earlier.Match == rule.Match {
+			return j
+		}
+		if prefix == "" {
+			continue
+		}
+		// An earlier rule without anchors which matches the prefix also
+		// matches any module containing it
+		earlierExpr, earlierAnchored := trimCaret(earlier.Match)
+		if (earlierAnchored && !anchored) || hasAnchors(earlierExpr) {
+			continue
+		}
+		if earlier.regexp.MatchString(prefix) {
+			return j
+		}
+	}
+	return -1
+}
+
+func trimCaret(expr string) (string, bool) {
+	if strings.HasPrefix(expr, "^") {
+		return expr[1:], true
+	}
+	return expr, false
+}
+
+func hasAnchors(expr string) bool {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return true
+	}
+	var walk func(*syntax.Regexp) bool
+	walk = func(re *syntax.Regexp) bool {
+		switch re.Op {
+		case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+			syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+			return true
+		}
+		for _, sub := range re.Sub {
+			if walk(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(re)
+}
+
+// resolveCommand implements the resolve command, printing where a module is
+// looked up and the commit a version resolves to.  Nothing is recorded in the
+// ledger.
+func resolveCommand(args []string) {
+	if len(args) != 1 {
+		log.Fatal("usage: resolve module[@version]")
+	}
+	c, err := parseConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	current.Store(c)
+
+	module, version := args[0], ""
+	if i := strings.LastIndex(module, "@"); i > 0 {
+		module, version = module[:i], module[i+1:]
+	}
+	lr, ok := c.Lookup(baseCtx, module)
+	if !ok {
+		fmt.Println(module, "not found")
+		os.Exit(1)
+	}
+	lr.probeGroups(baseCtx)
+	fmt.Printf("module:   %s\n", lr.orig)
+	fmt.Printf("rule:     %s\n", lr.rule)
+	fmt.Printf("git-url:  %s (%s)\n", lr.gitURL, lr.gitProvider)
+	fmt.Printf("repo:     %s\n", lr.baseGroupRepo)
+	fmt.Printf("path:     %s\n", lr.cleanPath)
+	if lr.majorVer != "" {
+		fmt.Printf("major:    %s\n", lr.majorVer)
+	}
+	if lr.passthrough {
+		fmt.Println("git-auth: passthrough, the configured token is used")
+	}
+	if version == "" {
+		return
+	}
+	ver, notice, err := getVersion(baseCtx, lr, version)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if notice != "" {
+		fmt.Println(notice)
+		os.Exit(1)
+	}
+	fmt.Printf("version:  %s\n", ver.Version)
+	fmt.Printf("commit:   %s\n", ver.Origin.Hash)
+	fmt.Printf("time:     %s\n", ver.Time)
+	if ver.Origin.Ref != "" {
+		fmt.Printf("ref:      %s\n", ver.Origin.Ref)
+	}
+	if ver.Origin.VCS == "cache" {
+		fmt.Printf("cache:    %s\n", ver.cachePath)
+	}
+}
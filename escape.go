@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Module paths and versions are sent and stored in their escaped form, with
+// each upper case letter replaced by an exclamation mark and the lower case
+// letter, so they are safe on case-insensitive file systems.  This follows
+// golang.org/x/mod/module.
+
+// unescapePath returns the module path of an escaped module path.
+func unescapePath(escaped string) (string, error) {
+	p, ok := unescapeString(escaped)
+	if !ok {
+		return "", fmt.Errorf("invalid escaped module path %q", escaped)
+	}
+	return p, nil
+}
+
+// unescapeVersion returns the version of an escaped version.
+func unescapeVersion(escaped string) (string, error) {
+	v, ok := unescapeString(escaped)
+	if !ok {
+		return "", fmt.Errorf("invalid escaped version %q", escaped)
+	}
+	return v, nil
+}
+
+// escapeString returns the escaped form of a module path or version.
+func escapeString(s string) (string, error) {
+	upper := false
+	for _, r := range s {
+		if r == '!' || r >= utf8.RuneSelf {
+			return "", fmt.Errorf("cannot escape %q", s)
+		}
+		if 'A' <= r && r <= 'Z' {
+			upper = true
+		}
+	}
+	if !upper {
+		return s, nil
+	}
+	var buf []byte
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			buf = append(buf, '!', byte(r+'a'-'A'))
+		} else {
+			buf = append(buf, byte(r))
+		}
+	}
+	return string(buf), nil
+}
+
+func unescapeString(escaped string) (string, bool) {
+	var buf []byte
+	bang := false
+	for _, r := range escaped {
+		if r >= utf8.RuneSelf {
+			return "", false
+		}
+		if bang {
+			bang = false
+			if r < 'a' || 'z' < r {
+				return "", false
+			}
+			buf = append(buf, byte(r+'A'-'a'))
+			continue
+		}
+		if r == '!' {
+			bang = true
+			continue
+		}
+		if 'A' <= r && r <= 'Z' {
+			return "", false
+		}
+		buf = append(buf, byte(r))
+	}
+	if bang {
+		return "", false
+	}
+	return string(buf), true
+}
+
+// cacheName returns the escaped form of a module path or version for use in
+// the local cache, or it as it is when it cannot be escaped.
+func cacheName(s string) string {
+	if escaped, err := escapeString(s); err == nil {
+		return escaped
+	}
+	return s
+}
+
+// requestModule returns the unescaped module path and version of the request,
+// the version is empty for list and latest.  When false is returned a reply
+// has already been sent.
+func requestModule(w http.ResponseWriter, r *http.Request) (module, version string, ok bool) {
+	vars := mux.Vars(r)
+	module, err := unescapePath(vars["module"])
+	if err == nil && vars["version"] != "" {
+		version, err = unescapeVersion(vars["version"])
+	}
+	if err != nil {
+		http.Error(w, "not found: "+err.Error(), http.StatusNotFound)
+		return "", "", false
+	}
+	return module, version, true
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestUnescapePath(t *testing.T) {
+	tests := []struct {
+		escaped, path string
+		ok            bool
+	}{
+		{"gitlab.com/grp/repo", "gitlab.com/grp/repo", true},
+		{"github.com/!azure/!go-!s!d!k", "github.com/Azure/Go-SDK", true},
+		{"", "", true},
+		{"github.com/Azure/sdk", "", false}, // upper case must be escaped
+		{"github.com/!!azure", "", false},
+		{"github.com/!1", "", false},
+		{"github.com/azure!", "", false},
+		{"github.com/é", "", false},
+	}
+	for _, tt := range tests {
+		p, err := unescapePath(tt.escaped)
+		if (err == nil) != tt.ok || p != tt.path {
+			t.Errorf("unescapePath(%q) = %q, %v, want %q, ok %t", tt.escaped, p, err, tt.path, tt.ok)
+		}
+	}
+}
+
+func TestEscapeString(t *testing.T) {
+	tests := []struct {
+		s, escaped string
+		ok         bool
+	}{
+		{"gitlab.com/grp/repo", "gitlab.com/grp/repo", true},
+		{"github.com/Azure/Go-SDK", "github.com/!azure/!go-!s!d!k", true},
+		{"v1.0.0-RC1", "v1.0.0-!r!c1", true},
+		{"github.com/!azure", "", false},
+		{"github.com/é", "", false},
+	}
+	for _, tt := range tests {
+		escaped, err := escapeString(tt.s)
+		if (err == nil) != tt.ok || escaped != tt.escaped {
+			t.Errorf("escapeString(%q) = %q, %v, want %q, ok %t", tt.s, escaped, err, tt.escaped, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if back, err := unescapePath(escaped); err != nil || back != tt.s {
+			t.Errorf("unescapePath(%q) = %q, %v, want %q", escaped, back, err, tt.s)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hosts of the modules served by the fake git servers of the selftest.
+const (
+	fakeGitLabHost = "gitlab.selftest"
+	fakeGitHubHost = "github.selftest"
+)
+
+// fakeGit answers the calls of the proxy to the GitLab (/api/v4) and GitHub
+// (/api/v3) APIs from local git repositories, kept under root by host/path.
+// Used as an HTTP proxy, it serves the same repositories to the go command in
+// direct mode with git http-backend.
+type fakeGit struct {
+	root string // ie: root/gitlab.selftest/grp/repo
+	git  string // the git command
+	addr string // host:port the server listens on
+}
+
+func (f *fakeGit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		// Only plain HTTP, the go command then falls back to it (GOINSECURE)
+		http.Error(w, "no https in the selftest", http.StatusForbidden)
+	case r.URL.IsAbs():
+		f.direct(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/v4/"):
+		f.gitlab(w, r, pathSegments(r, "/api/v4/"))
+	case strings.HasPrefix(r.URL.Path, "/api/v3/"):
+		f.github(w, r, pathSegments(r, "/api/v3/"))
+	case strings.HasPrefix(r.URL.Path, "/archive/"):
+		// GitHub tarball links: /archive/owner/repo/sha
+		p := pathSegments(r, "/archive/")
+		if len(p) != 3 {
+			http.NotFound(w, r)
+			return
+		}
+		f.archive(w, r, fakeGitHubHost+"/"+p[0]+"/"+p[1], p[0]+"-"+p[1]+"-"+shortSha(p[2]), p[2])
+	case strings.HasPrefix(r.URL.Path, "/raw/"):
+		// GitHub download links: /raw/owner/repo/sha/path/to/file
+		p := pathSegments(r, "/raw/")
+		if len(p) < 4 {
+			http.NotFound(w, r)
+			return
+		}
+		f.file(w, r, fakeGitHubHost+"/"+p[0]+"/"+p[1], p[2], path.Join(p[3:]...))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// pathSegments splits the escaped path after prefix, so the project ids of
+// GitLab (grp%2Frepo) stay in one piece.
+func pathSegments(r *http.Request, prefix string) []string {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), prefix), "/")
+	for i, p := range parts {
+		if s, err := url.PathUnescape(p); err == nil {
+			parts[i] = s
+		}
+	}
+	return parts
+}
+
+func (f *fakeGit) gitlab(w http.ResponseWriter, r *http.Request, p []string) {
+	if len(p) < 2 || p[0] != "projects" || !f.exists(fakeGitLabHost+"/"+p[1]) {
+		apiNotFound(w, "404 Project Not Found")
+		return
+	}
+	project := p[1]
+	repo := fakeGitLabHost + "/" + project
+	ctx := r.Context()
+	switch {
+	case len(p) == 2:
+		writeJSON(w, map[string]interface{}{"id": 1, "path_with_namespace": project,
+			"default_branch": "main", "web_url": "http://" + repo})
+	case len(p) == 3 && p[2] == "releases":
+		// Every tag is taken as a release, newest first
+		var releases []map[string]interface{}
+		for _, tag := range f.tags(ctx, repo, "-creatordate") {
+			releases = append(releases, map[string]interface{}{"tag_name": tag, "name": tag})
+		}
+		writeJSON(w, page(r, releases, 20))
+	case len(p) == 4 && p[2] == "repository" && p[3] == "commits":
+		var commits []map[string]interface{}
+		for _, c := range f.log(ctx, repo, "HEAD", perPage(r, 20)) {
+			commits = append(commits, c.gitlab())
+		}
+		writeJSON(w, commits)
+	case len(p) == 5 && p[2] == "repository" && p[3] == "commits":
+		c, ok := f.commit(ctx, repo, p[4])
+		if !ok {
+			apiNotFound(w, "404 Commit Not Found")
+			return
+		}
+		writeJSON(w, c.gitlab())
+	case len(p) == 4 && p[2] == "repository" && p[3] == "tags":
+		var tags []map[string]interface{}
+		for _, tag := range f.tags(ctx, repo, "-creatordate") {
+			if c, ok := f.commit(ctx, repo, "refs/tags/"+tag); ok {
+				tags = append(tags, map[string]interface{}{"name": tag, "target": c.sha, "commit": c.gitlab()})
+			}
+		}
+		writeJSON(w, page(r, tags, 20))
+	case len(p) == 4 && p[2] == "repository" && p[3] == "merge_base":
+		refs := r.URL.Query()["refs[]"]
+		if len(refs) != 2 {
+			http.Error(w, `{"message":"refs is missing"}`, http.StatusBadRequest)
+			return
+		}
+		out, err := f.run(ctx, repo, "merge-base", "--", refs[0], refs[1])
+		c, ok := f.commit(ctx, repo, strings.TrimSpace(string(out)))
+		if err != nil || !ok {
+			apiNotFound(w, "404 Merge Base Not Found")
+			return
+		}
+		writeJSON(w, c.gitlab())
+	case len(p) == 5 && p[2] == "repository" && p[3] == "tags":
+		c, ok := f.commit(ctx, repo, "refs/tags/"+p[4])
+		if !ok {
+			apiNotFound(w, "404 Tag Not Found")
+			return
+		}
+		writeJSON(w, map[string]interface{}{"name": p[4], "target": c.sha, "commit": c.gitlab()})
+	case len(p) == 4 && p[2] == "repository" && p[3] == "archive.tar.gz":
+		c, ok := f.commit(ctx, repo, r.URL.Query().Get("sha"))
+		if !ok {
+			apiNotFound(w, "404 Commit Not Found")
+			return
+		}
+		f.archive(w, r, repo, path.Base(project)+"-"+c.sha+"-"+c.sha, c.sha)
+	case len(p) == 6 && p[2] == "repository" && p[3] == "files" && p[5] == "raw":
+		f.file(w, r, repo, r.URL.Query().Get("ref"), p[4])
+	default:
+		apiNotFound(w, "404 Not Found")
+	}
+}
+
+func (f *fakeGit) github(w http.ResponseWriter, r *http.Request, p []string) {
+	if len(p) < 4 || p[0] != "repos" || !f.exists(fakeGitHubHost+"/"+p[1]+"/"+p[2]) {
+		apiNotFound(w, "Not Found")
+		return
+	}
+	owner, name := p[1], p[2]
+	repo := fakeGitHubHost + "/" + owner + "/" + name
+	ctx := r.Context()
+	switch {
+	case len(p) == 4 && p[3] == "commits":
+		var commits []map[string]interface{}
+		for _, c := range f.log(ctx, repo, "HEAD", perPage(r, 30)) {
+			commits = append(commits, c.github())
+		}
+		writeJSON(w, commits)
+	case len(p) == 5 && p[3] == "commits":
+		c, ok := f.commit(ctx, repo, p[4])
+		if !ok {
+			http.Error(w, `{"message":"No commit found for SHA: `+p[4]+`"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, c.github())
+	case len(p) == 4 && p[3] == "tags":
+		var tags []map[string]interface{}
+		for _, tag := range f.tags(ctx, repo, "-v:refname") {
+			if c, ok := f.commit(ctx, repo, "refs/tags/"+tag); ok {
+				tags = append(tags, map[string]interface{}{"name": tag, "commit": map[string]string{"sha": c.sha}})
+			}
+		}
+		writeJSON(w, page(r, tags, 30))
+	case len(p) == 5 && p[3] == "compare":
+		// base...head, as ahead when head comes after base
+		base, head, _ := strings.Cut(p[4], "...")
+		b, okBase := f.commit(ctx, repo, base)
+		h, okHead := f.commit(ctx, repo, head)
+		if !okBase || !okHead {
+			apiNotFound(w, "Not Found")
+			return
+		}
+		status := "diverged"
+		switch {
+		case b.sha == h.sha:
+			status = "identical"
+		case f.command(ctx, repo, "merge-base", "--is-ancestor", b.sha, h.sha).Run() == nil:
+			status = "ahead"
+		case f.command(ctx, repo, "merge-base", "--is-ancestor", h.sha, b.sha).Run() == nil:
+			status = "behind"
+		}
+		writeJSON(w, map[string]interface{}{"status": status})
+	case len(p) == 5 && p[3] == "tarball":
+		c, ok := f.commit(ctx, repo, p[4])
+		if !ok {
+			apiNotFound(w, "Not Found")
+			return
+		}
+		http.Redirect(w, r, "http://"+f.addr+"/archive/"+owner+"/"+name+"/"+c.sha, http.StatusFound)
+	case p[3] == "contents":
+		ref := r.URL.Query().Get("ref")
+		c, ok := f.commit(ctx, repo, ref)
+		if !ok {
+			apiNotFound(w, "Not Found")
+			return
+		}
+		dir := strings.Trim(path.Join(p[4:]...), "/.")
+		args := []string{"ls-tree", c.sha}
+		if dir != "" {
+			args = append(args, "--", dir+"/")
+		}
+		out, err := f.run(ctx, repo, args...)
+		if err != nil {
+			apiNotFound(w, "Not Found")
+			return
+		}
+		var entries []map[string]interface{}
+		s := bufio.NewScanner(bytes.NewReader(out))
+		for s.Scan() {
+			// <mode> <type> <object>\t<path>
+			meta, file, _ := strings.Cut(s.Text(), "\t")
+			e := map[string]interface{}{"name": path.Base(file), "path": file, "type": "dir"}
+			if strings.Contains(meta, " blob ") {
+				e["type"] = "file"
+				e["download_url"] = "http://" + f.addr + "/raw/" + owner + "/" + name + "/" + c.sha + "/" + file
+			}
+			entries = append(entries, e)
+		}
+		writeJSON(w, entries)
+	default:
+		apiNotFound(w, "Not Found")
+	}
+}
+
+// direct serves the repositories as the go command finds them without a
+// proxy: the go-import meta tag, then the git smart HTTP protocol.
+func (f *fakeGit) direct(w http.ResponseWriter, r *http.Request) {
+	host, p := r.URL.Hostname(), strings.Trim(r.URL.Path, "/")
+	repo := ""
+	for parts := strings.Split(p, "/"); len(parts) > 0 && repo == ""; parts = parts[:len(parts)-1] {
+		if f.exists(host + "/" + strings.Join(parts, "/")) {
+			repo = host + "/" + strings.Join(parts, "/")
+		}
+	}
+	if repo == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("go-get") == "1" {
+		fmt.Fprintf(w, "<html><head><meta name=\"go-import\" content=\"%s git http://%s\"></head></html>\n", repo, repo)
+		return
+	}
+	r = r.Clone(r.Context())
+	r.URL.Path = "/" + host + "/" + p
+	(&cgi.Handler{
+		Path: f.git,
+		Args: []string{"http-backend"},
+		Root: "/",
+		Env: []string{"GIT_PROJECT_ROOT=" + f.root, "GIT_HTTP_EXPORT_ALL=1",
+			"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=" + os.DevNull},
+	}).ServeHTTP(w, r)
+}
+
+// archive streams the tarball of a commit, with its files under prefix/ as
+// the git servers do.
+func (f *fakeGit) archive(w http.ResponseWriter, r *http.Request, repo, prefix, sha string) {
+	var buf bytes.Buffer
+	cmd := f.command(r.Context(), repo, "archive", "--format=tar.gz", "--prefix="+prefix+"/", sha)
+	cmd.Stdout = &buf
+	if err := cmd.Run(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+func (f *fakeGit) file(w http.ResponseWriter, r *http.Request, repo, ref, file string) {
+	c, ok := f.commit(r.Context(), repo, ref)
+	if !ok {
+		apiNotFound(w, "404 Commit Not Found")
+		return
+	}
+	out, err := f.run(r.Context(), repo, "show", c.sha+":"+file)
+	if err != nil {
+		apiNotFound(w, "404 File Not Found")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+}
+
+type fakeCommit struct {
+	sha  string
+	time time.Time
+}
+
+func (c fakeCommit) gitlab() map[string]interface{} {
+	return map[string]interface{}{"id": c.sha, "short_id": c.sha[:8],
+		"committed_date": c.time, "authored_date": c.time, "created_at": c.time}
+}
+
+func (c fakeCommit) github() map[string]interface{} {
+	sig := map[string]interface{}{"name": "selftest", "date": c.time}
+	return map[string]interface{}{"sha": c.sha, "commit": map[string]interface{}{"author": sig, "committer": sig}}
+}
+
+// commit resolves a branch, tag or (short) hash to its commit.
+func (f *fakeGit) commit(ctx context.Context, repo, ref string) (fakeCommit, bool) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return fakeCommit{}, false
+	}
+	commits := f.log(ctx, repo, ref+"^{commit}", 1)
+	if len(commits) == 0 {
+		return fakeCommit{}, false
+	}
+	return commits[0], true
+}
+
+// log returns the last n commits of rev, newest first.
+func (f *fakeGit) log(ctx context.Context, repo, rev string, n int) (commits []fakeCommit) {
+	out, err := f.run(ctx, repo, "log", "-n", strconv.Itoa(n), "--format=%H %cI", rev, "--")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		sha, date, _ := strings.Cut(line, " ")
+		if t, err := time.Parse(time.RFC3339, date); err == nil {
+			commits = append(commits, fakeCommit{sha: sha, time: t.UTC()})
+		}
+	}
+	return
+}
+
+func (f *fakeGit) tags(ctx context.Context, repo, sort string) []string {
+	out, err := f.run(ctx, repo, "for-each-ref", "--sort="+sort, "--format=%(refname:strip=2)", "refs/tags")
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(out))
+}
+
+func (f *fakeGit) exists(repo string) bool {
+	info, err := os.Stat(filepath.Join(f.root, filepath.FromSlash(repo), ".git"))
+	return err == nil && info.IsDir()
+}
+
+func (f *fakeGit) run(ctx context.Context, repo string, args ...string) ([]byte, error) {
+	return f.command(ctx, repo, args...).Output()
+}
+
+// command runs git in a repository, without the settings of the user.
+func (f *fakeGit) command(ctx context.Context, repo string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, f.git, args...)
+	cmd.Dir = filepath.Join(f.root, filepath.FromSlash(repo))
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL="+os.DevNull)
+	return cmd
+}
+
+func perPage(r *http.Request, def int) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get("per_page")); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// page returns the first page of a listing, the proxy does not ask for more.
+func page(r *http.Request, items []map[string]interface{}, def int) []map[string]interface{} {
+	if n := perPage(r, def); len(items) > n {
+		return items[:n]
+	}
+	return items
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiNotFound(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
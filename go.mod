@@ -1,4 +1,4 @@
-module main
+module goproxy
 
 go 1.18
 
@@ -6,7 +6,6 @@ require (
 	github.com/google/go-github/v50 v50.1.0
 	github.com/gorilla/mux v1.8.0
 	github.com/pschou/go-memdiskbuf v0.0.0-20230224193926-5c075fe07f50
-	github.com/pschou/go-tease v0.0.0-20221025010209-0509f9668b80
 	github.com/xanzy/go-gitlab v0.80.2
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+// How long the result of a readiness probe is reused, so a busy load
+// balancer does not turn into load on the git servers.
+const probeTTL = 30 * time.Second
+
+type probeResult struct {
+	Name     string `json:"name"`
+	URL      string `json:"url,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Latency  string `json:"latency,omitempty"`
+	Checked  string `json:"checked"`
+}
+
+// A cached probe of one of the backends.
+type probe struct {
+	name, url, provider string
+	passthrough         bool
+	check               func() error
+
+	mu     sync.Mutex
+	result probeResult
+	at     time.Time
+}
+
+var (
+	probesMu sync.Mutex
+	probes   []*probe
+)
+
+func (p *probe) run() probeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.at) < probeTTL {
+		return p.result
+	}
+	start := time.Now()
+	err := p.check()
+	p.at = time.Now()
+	p.result = probeResult{Name: p.name, URL: p.url, Provider: p.provider, OK: err == nil,
+		Latency: time.Since(start).String(), Checked: p.at.UTC().Format(time.RFC3339)}
+	if err != nil {
+		p.result.Error = err.Error()
+	}
+	return p.result
+}
+
+// loadProbes sets up the readiness probes of the config.
+func loadProbes(data *yamlParse) {
+	list := probesFor(data)
+	probesMu.Lock()
+	probes = list
+	probesMu.Unlock()
+}
+
+// probesFor returns probes for the configured backends and the local cache.
+func probesFor(data *yamlParse) (list []*probe) {
+	if data.gitClient != nil {
+		list = append(list, gitProbe("default", data.GitLabURL, data.GitLabProvider, data.GitAuth, data.gitClient))
+	}
+	for _, elm := range data.Regexp {
+		if elm.gitClient != nil {
+			list = append(list, gitProbe(elm.Match, elm.GitLabURL, elm.GitLabProvider, elm.GitAuth, elm.gitClient))
+		}
+	}
+	if data.LocalCache != "" {
+		dir := data.LocalCache
+		list = append(list, &probe{name: "local-cache", url: dir, check: func() error { return checkCacheWritable(dir) }})
+	}
+	return
+}
+
+func gitProbe(name, apiurl, prov, auth string, client interface{}) *probe {
+	p := &probe{name: name, url: apiurl, provider: prov, passthrough: auth == "passthrough"}
+	p.check = func() error { return checkBackend(client, p.passthrough) }
+	return p
+}
+
+// checkBackend makes a cheap authenticated call to the git server.  Without a
+// token of our own (pass-through) the server only needs to be reachable.
+func checkBackend(client interface{}, passthrough bool) error {
+	ctx, cancel := context.WithTimeout(baseCtx, *apiTimeout)
+	defer cancel()
+	var resp *http.Response
+	var err error
+	switch c := client.(type) {
+	case *gitlab.Client:
+		var r *gitlab.Response
+		_, r, err = c.Version.GetVersion(gitlab.WithContext(ctx))
+		if r != nil {
+			resp = r.Response
+		}
+	case *github.Client:
+		var r *github.Response
+		_, r, err = c.RateLimits(ctx)
+		if r != nil {
+			resp = r.Response
+		}
+	default: // offline
+		return nil
+	}
+	if err != nil && passthrough && resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		return nil
+	}
+	return err
+}
+
+func checkCacheWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fh, err := os.CreateTemp(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	fh.Close()
+	return os.Remove(fh.Name())
+}
+
+// healthz reports the process is alive.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+type readiness struct {
+	Ready    bool          `json:"ready"`
+	Backends []probeResult `json:"backends"`
+	Stopping bool          `json:"stopping,omitempty"`
+}
+
+// readyz reports whether the backends can be used with the status code only,
+// as the main listeners are open to anyone.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !checkReady().Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// readyzDetails reports whether the backends can be used, as JSON with the
+// status of each backend, for the admin listener.
+func readyzDetails(w http.ResponseWriter, r *http.Request) {
+	reply := checkReady()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !reply.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(reply)
+}
+
+func checkReady() readiness {
+	probesMu.Lock()
+	list := probes
+	probesMu.Unlock()
+
+	reply := readiness{Ready: true, Backends: []probeResult{}}
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		reply.Ready, reply.Stopping = false, true
+	}
+
+	results := make([]probeResult, len(list))
+	var wg sync.WaitGroup
+	for i, p := range list {
+		wg.Add(1)
+		go func(i int, p *probe) {
+			defer wg.Done()
+			results[i] = p.run()
+		}(i, p)
+	}
+	wg.Wait()
+	for _, res := range results {
+		reply.Ready = reply.Ready && res.OK
+		reply.Backends = append(reply.Backends, res)
+	}
+	return reply
+}
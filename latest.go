@@ -1,14 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/google/go-github/v50/github"
-	"github.com/gorilla/mux"
 	"github.com/xanzy/go-gitlab"
 )
 
@@ -16,30 +15,31 @@ func latest(w http.ResponseWriter, r *http.Request) {
 	var reply VersionData
 	reply.Origin.VCS = "git"
 
-	if *verbose {
-		log.Printf("Got latest request: %#v", r)
-	}
 	// find a project ID by module name
-	module := mux.Vars(r)["module"]
-	lr, ok := Lookup(module)
-	//fmt.Println("found", project, client, ok)
+	module, _, ok := requestModule(w, r)
+	if !ok {
+		return
+	}
+	lr, ok := lookup(w, r, module)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	if !useClientCredentials(w, r, lr) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), *apiTimeout)
+	defer cancel()
 	switch client := lr.git.(type) {
 	case *gitlab.Client:
-		//fmt.Println("looking up releases")
 		releases, _, err := client.Releases.ListReleases(lr.groupRepo,
-			&gitlab.ListReleasesOptions{ListOptions: gitlab.ListOptions{PerPage: 1}})
-		//fmt.Println("err: ", err)
+			&gitlab.ListReleasesOptions{ListOptions: gitlab.ListOptions{PerPage: 1}}, gitlab.WithContext(ctx))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			upstreamError(w, err)
 			return
 		}
 
 		if len(releases) > 0 {
-			//fmt.Printf("releases: %s %#v\n", err, releases)
 			for _, entry := range releases {
 				fmt.Fprintf(w, "%s\n", entry.TagName)
 			}
@@ -47,7 +47,11 @@ func latest(w http.ResponseWriter, r *http.Request) {
 		}
 
 		commits, _, err := client.Commits.ListCommits(lr.groupRepo,
-			&gitlab.ListCommitsOptions{ListOptions: gitlab.ListOptions{PerPage: 1}})
+			&gitlab.ListCommitsOptions{ListOptions: gitlab.ListOptions{PerPage: 1}}, gitlab.WithContext(ctx))
+		if err != nil {
+			upstreamError(w, err)
+			return
+		}
 
 		if len(commits) == 1 {
 			commit := commits[0]
@@ -61,12 +65,14 @@ func latest(w http.ResponseWriter, r *http.Request) {
 			reply.Time = commit.CommittedDate.UTC().Format(time.RFC3339)
 			reply.Origin.Hash = commit.ID
 		}
-		//fmt.Printf("commits: %s %#v\n", err, commits)
 	case *github.Client:
-		releases, _, _ := client.Repositories.ListTags(ctx, lr.group, lr.repo,
+		releases, _, err := client.Repositories.ListTags(ctx, lr.group, lr.repo,
 			&github.ListOptions{PerPage: 1})
+		if err != nil {
+			upstreamError(w, err)
+			return
+		}
 		if len(releases) > 0 {
-			//fmt.Printf("releases: %s %#v\n", err, releases)
 			for _, entry := range releases {
 				fmt.Fprintf(w, "%s\n", *entry.Name)
 			}
@@ -75,8 +81,9 @@ func latest(w http.ResponseWriter, r *http.Request) {
 
 		commits, _, err := client.Repositories.ListCommits(ctx, lr.group, lr.repo,
 			&github.CommitsListOptions{ListOptions: github.ListOptions{PerPage: 1}})
-		if *verbose && err != nil {
-			log.Println("error listing", err)
+		if err != nil {
+			upstreamError(w, err)
+			return
 		}
 
 		// build output
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An append-only record of what was served for each module@version.  Once a
+// version has been served, later fetches must resolve to the same commit and
+// hash to the same content, otherwise a tag was moved or history rewritten.
+type ledgerEntry struct {
+	Time    string `json:"time"`
+	Module  string `json:"module"`
+	Version string `json:"version"`
+	Hash    string `json:"hash"`
+	Sum     string `json:"h1,omitempty"`
+	ModSum  string `json:"go.mod,omitempty"`
+
+	// Set on entries which differ from the accepted one, until an admin
+	// accepts the change.
+	Status string `json:"status,omitempty"`
+}
+
+const (
+	ledgerConflict = "conflict"
+	ledgerAccepted = "accepted"
+)
+
+type ledgerState struct {
+	mu       sync.Mutex
+	file     string
+	size     int64
+	known    map[string]ledgerEntry
+	conflict map[string]ledgerEntry
+}
+
+var ledger ledgerState
+
+func ledgerKey(module, version string) string { return module + "@" + version }
+
+// matches reports whether the entry agrees with the accepted one, ignoring
+// sums which are not known on either side.
+func (e ledgerEntry) matches(prev ledgerEntry) bool {
+	return e.Hash == prev.Hash &&
+		(e.Sum == "" || prev.Sum == "" || e.Sum == prev.Sum) &&
+		(e.ModSum == "" || prev.ModSum == "" || e.ModSum == prev.ModSum)
+}
+
+// merge fills in the sums which were not yet known.
+func (e ledgerEntry) merge(prev ledgerEntry) (ledgerEntry, bool) {
+	changed := false
+	if e.Sum == "" {
+		e.Sum = prev.Sum
+	} else if prev.Sum == "" {
+		changed = true
+	}
+	if e.ModSum == "" {
+		e.ModSum = prev.ModSum
+	} else if prev.ModSum == "" {
+		changed = true
+	}
+	return e, changed
+}
+
+var ledgerLogger = newLogger("ledger")
+
+func loadLedger(file string) {
+	ledger.file = file
+	if err := ledger.load(); err != nil {
+		log.Fatal("Error loading ledger: ", err)
+	}
+	ledgerLogger.Debug("Loaded ledger", "file", file, "entries", len(ledger.known), "conflicts", len(ledger.conflict))
+}
+
+// load reads in the ledger, the last entry for each module@version wins.
+func (l *ledgerState) load() error {
+	l.known = make(map[string]ledgerEntry)
+	l.conflict = make(map[string]ledgerEntry)
+	fh, err := os.Open(l.file)
+	if os.IsNotExist(err) {
+		l.size = 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e ledgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %w", l.file, line, err)
+		}
+		key := ledgerKey(e.Module, e.Version)
+		if e.Status == ledgerConflict {
+			l.conflict[key] = e
+		} else {
+			l.known[key] = e
+			delete(l.conflict, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	stat, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	l.size = stat.Size()
+	return nil
+}
+
+// refresh picks up entries appended by another process, such as an admin
+// accepting a change.
+func (l *ledgerState) refresh() error {
+	stat, err := os.Stat(l.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if stat.Size() != l.size {
+		return l.load()
+	}
+	return nil
+}
+
+func (l *ledgerState) append(e ledgerEntry) error {
+	fh, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n, err := fh.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return fh.Sync()
+}
+
+// ledgerCheck records what is about to be served for module@version and
+// compares it with what was served before.  An error is returned when the
+// content changed and the policy is to refuse serving it.
+func ledgerCheck(lr *lookupResult, e ledgerEntry) error {
+	if ledger.file == "" {
+		return nil
+	}
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	if err := ledger.refresh(); err != nil {
+		ledgerLogger.Error("Error reading ledger", "err", err)
+	}
+
+	key := ledgerKey(e.Module, e.Version)
+	prev, ok := ledger.known[key]
+	if ok && e.matches(prev) {
+		if merged, changed := e.merge(prev); changed {
+			merged.Time = time.Now().UTC().Format(time.RFC3339)
+			if err := ledger.append(merged); err != nil {
+				ledgerLogger.Error("Error writing ledger", "err", err)
+			}
+			ledger.known[key] = merged
+		}
+		return nil
+	}
+
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	if !ok {
+		if err := ledger.append(e); err != nil {
+			ledgerLogger.Error("Error writing ledger", "err", err)
+		}
+		ledger.known[key] = e
+		return nil
+	}
+
+	// The content differs from what has been served before
+	e.Status = ledgerConflict
+	if c, seen := ledger.conflict[key]; !seen || !c.matches(e) {
+		if err := ledger.append(e); err != nil {
+			ledgerLogger.Error("Error writing ledger", "err", err)
+		}
+		ledger.conflict[key] = e
+	}
+	ledgerLogger.Error("LEDGER MISMATCH", "module", key, "served_commit", prev.Hash, "served_h1", prev.Sum,
+		"upstream_commit", e.Hash, "upstream_h1", e.Sum)
+	if lr.conf.LedgerPolicy == "alert" {
+		return nil
+	}
+	return fmt.Errorf("%s: content differs from the version previously served (commit %s), "+
+		"the tag may have been moved; an admin must accept the change", key, prev.Hash)
+}
+
+// ledgerCommand implements the ledger admin commands.
+func ledgerCommand(args []string) {
+	if config().Ledger == "" {
+		log.Fatal("No ledger configured in ", *configFile)
+	}
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	if len(args) == 0 {
+		args = []string{"pending"}
+	}
+	switch args[0] {
+	case "list":
+		printLedger(ledger.known)
+	case "pending":
+		printLedger(ledger.conflict)
+	case "accept":
+		if len(args) < 2 {
+			log.Fatal("usage: ledger accept module@version ...")
+		}
+		for _, key := range args[1:] {
+			e, ok := ledger.conflict[key]
+			if !ok {
+				log.Fatal("No pending change for ", key)
+			}
+			e.Status = ledgerAccepted
+			e.Time = time.Now().UTC().Format(time.RFC3339)
+			if err := ledger.append(e); err != nil {
+				log.Fatal(err)
+			}
+			ledger.known[key] = e
+			delete(ledger.conflict, key)
+			fmt.Println("accepted", key, "commit", e.Hash)
+		}
+	default:
+		log.Fatal("Unknown ledger command ", args[0], ", expected list, pending or accept")
+	}
+}
+
+func printLedger(entries map[string]ledgerEntry) {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e := entries[k]
+		line := fmt.Sprintf("%s commit %s", k, e.Hash)
+		if e.Sum != "" {
+			line += " h1:" + e.Sum
+		}
+		if prev, ok := ledger.known[k]; ok && e.Status == ledgerConflict {
+			line += fmt.Sprintf(" (was commit %s h1:%s, first seen %s)", prev.Hash, prev.Sum, prev.Time)
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLedgerCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ledger.jsonl")
+	ledger = ledgerState{file: file}
+	t.Cleanup(func() { ledger = ledgerState{} })
+	if err := ledger.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	const m = "gitlab.com/grp/repo"
+	steps := []struct {
+		policy  string
+		entry   ledgerEntry
+		refused bool
+	}{
+		{"refuse", ledgerEntry{Module: m, Version: "v1.0.0", Hash: "aaaa", Sum: "h1:zip"}, false},
+		{"refuse", ledgerEntry{Module: m, Version: "v1.0.0", Hash: "aaaa", Sum: "h1:zip"}, false},
+		{"refuse", ledgerEntry{Module: m, Version: "v1.0.0", Hash: "aaaa", ModSum: "h1:mod"}, false}, // fills in the go.mod sum
+		{"refuse", ledgerEntry{Module: m, Version: "v1.0.0", Hash: "aaaa", Sum: "h1:other"}, true},
+		{"refuse", ledgerEntry{Module: m, Version: "v1.0.0", Hash: "bbbb"}, true},
+		{"refuse", ledgerEntry{Module: m, Version: "v1.0.0", Hash: "bbbb"}, true}, // recorded once
+		{"alert", ledgerEntry{Module: m, Version: "v1.0.0", Hash: "bbbb"}, false},
+		{"refuse", ledgerEntry{Module: m, Version: "v1.1.0", Hash: "bbbb"}, false},
+	}
+	for i, s := range steps {
+		lr := &lookupResult{conf: &yamlParse{LedgerPolicy: s.policy}}
+		if err := ledgerCheck(lr, s.entry); (err != nil) != s.refused {
+			t.Errorf("step %d: ledgerCheck(%s@%s %s) = %v, want refused %t",
+				i+1, s.entry.Module, s.entry.Version, s.entry.Hash, err, s.refused)
+		}
+	}
+
+	// The first entry, its merge, two conflicts and the new version
+	fh, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(fh); scanner.Scan(); {
+		lines++
+	}
+	if lines != 5 {
+		t.Errorf("ledger has %d entries, want 5", lines)
+	}
+
+	// What is read back agrees with what was checked
+	if err := ledger.load(); err != nil {
+		t.Fatal(err)
+	}
+	key := ledgerKey(m, "v1.0.0")
+	if e := ledger.known[key]; e.Hash != "aaaa" || e.Sum != "h1:zip" || e.ModSum != "h1:mod" {
+		t.Errorf("known %s = %+v, want commit aaaa with both sums", key, e)
+	}
+	if e, ok := ledger.conflict[key]; !ok || e.Hash != "bbbb" || e.Status != ledgerConflict {
+		t.Errorf("conflict %s = %+v, want commit bbbb", key, e)
+	}
+	if _, ok := ledger.known[ledgerKey(m, "v1.1.0")]; !ok {
+		t.Errorf("%s@v1.1.0 not in the ledger", m)
+	}
+}
@@ -1,61 +1,57 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
 
 	"github.com/google/go-github/v50/github"
-	"github.com/gorilla/mux"
 	"github.com/xanzy/go-gitlab"
 )
 
 func list(w http.ResponseWriter, r *http.Request) {
-	if *verbose {
-		log.Printf("Got list request: %#v", r)
-	}
 	// find a project ID by module name
-	module := mux.Vars(r)["module"]
-	lr, ok := Lookup(module)
-	fmt.Printf("found %#v\n", lr)
+	module, _, ok := requestModule(w, r)
+	if !ok {
+		return
+	}
+	lr, ok := lookup(w, r, module)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	if !useClientCredentials(w, r, lr) {
+		return
+	}
 	perPage := 10
-	if lr.majorVer != "" {
+	if lr.majorVer != "" || lr.cleanPath != "" {
 		perPage = 1000
 	}
+	ctx, cancel := context.WithTimeout(r.Context(), *apiTimeout)
+	defer cancel()
 	switch client := lr.git.(type) {
 	case *gitlab.Client:
-		//fmt.Println("looking up releases")
 		releases, _, err := client.Releases.ListReleases(lr.groupRepo,
-			&gitlab.ListReleasesOptions{ListOptions: gitlab.ListOptions{PerPage: perPage}})
-		//fmt.Println("err: ", err)
+			&gitlab.ListReleasesOptions{ListOptions: gitlab.ListOptions{PerPage: perPage}}, gitlab.WithContext(ctx))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			upstreamError(w, err)
 			return
 		}
-		if lr.majorVer != "" {
+		if len(releases) > 0 {
 			for _, entry := range releases {
-				if strings.HasPrefix(entry.TagName, lr.majorVer+".") || entry.TagName == lr.majorVer {
-					fmt.Fprintf(w, "%s\n", entry.TagName)
+				if version, _, ok := lr.tagVersion(entry.TagName); ok {
+					fmt.Fprintf(w, "%s\n", version)
 				}
 			}
 			return
 		}
 
-		if len(releases) > 0 {
-			//fmt.Printf("releases: %s %#v\n", err, releases)
-			for _, entry := range releases {
-				fmt.Fprintf(w, "%s\n", entry.TagName)
-			}
+		commits, _, err := client.Commits.ListCommits(lr.groupRepo,
+			&gitlab.ListCommitsOptions{ListOptions: gitlab.ListOptions{PerPage: 10}}, gitlab.WithContext(ctx))
+		if err != nil {
+			upstreamError(w, err)
 			return
 		}
-
-		commits, _, err := client.Commits.ListCommits(lr.groupRepo,
-			&gitlab.ListCommitsOptions{ListOptions: gitlab.ListOptions{PerPage: 10}})
 		for _, commit := range commits {
 			// build output
 			fmt.Fprintf(w,
@@ -64,36 +60,30 @@ func list(w http.ResponseWriter, r *http.Request) {
 				commit.ID[0:12],
 			)
 		}
-		//fmt.Printf("commits: %s %#v\n", err, commits)
 	case *github.Client:
 		releases, _, err := client.Repositories.ListTags(ctx, lr.group, lr.repo,
 			&github.ListOptions{PerPage: perPage})
-		fmt.Println("err:", err)
-		if lr.majorVer != "" {
-			for _, entry := range releases {
-				if strings.HasPrefix(*entry.Name, lr.majorVer+".") || *entry.Name == lr.majorVer {
-					fmt.Fprintf(w, "%s\n", *entry.Name)
-				}
-			}
+		if err != nil {
+			upstreamError(w, err)
 			return
 		}
 		if len(releases) > 0 {
-			//fmt.Printf("releases: %s %#v\n", err, releases)
 			for _, entry := range releases {
-				fmt.Fprintf(w, "%s\n", *entry.Name)
+				if version, _, ok := lr.tagVersion(*entry.Name); ok {
+					fmt.Fprintf(w, "%s\n", version)
+				}
 			}
 			return
 		}
 
 		commits, _, err := client.Repositories.ListCommits(ctx, lr.group, lr.repo,
 			&github.CommitsListOptions{ListOptions: github.ListOptions{PerPage: 10}})
-		if *verbose && err != nil {
-			log.Println("error listing", err)
+		if err != nil {
+			upstreamError(w, err)
+			return
 		}
 
 		for _, commit := range commits {
-			//adat, _ := json.MarshalIndent(commit.SHA, "", "  ")
-			//fmt.Printf("sha: %s %s\n", err, adat)
 			// build output
 			sha := *(commit.SHA)
 			fmt.Fprintf(w,
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A listener of the server, with the auth policy of its clients.  Listeners
+// are set up at startup, only their access rules and open change on a
+// reload.
+type yamlListener struct {
+	// host:port, unix:/path/to.sock, or systemd (all the sockets passed by
+	// systemd) or systemd:name (the ones with FileDescriptorName=name)
+	Address    string `yaml:"address"`
+	TLS        bool   `yaml:"tls"`
+	ClientAuth string `yaml:"client-auth"` // none, request or require, default the top level one
+	Mode       string `yaml:"mode"`        // permissions of a unix socket, ie: "0660"
+
+	// Reply to everything but /healthz and /readyz with a redirect to https
+	// on this host:port, or :port of the host asked for
+	Redirect string `yaml:"redirect"`
+
+	// Access rules for the clients of this listener instead of the top level
+	// ones, or none at all for trusted clients such as a local sidecar
+	Access []yamlAccess `yaml:"access"`
+	Open   bool         `yaml:"open"`
+
+	mode os.FileMode
+}
+
+type listenerKey struct{}
+
+// listenerSettings sums up the listeners to tell the changes made by a
+// reload.
+func listenerSettings(data *yamlParse) string {
+	var s strings.Builder
+	for _, l := range data.Listeners {
+		fmt.Fprintf(&s, "%s tls=%t client-auth=%s mode=%s redirect=%s\n",
+			l.Address, l.TLS, l.ClientAuth, l.Mode, l.Redirect)
+	}
+	return s.String()
+}
+
+func (data *yamlParse) loadListeners() error {
+	for i := range data.Listeners {
+		l := &data.Listeners[i]
+		if l.Address == "" {
+			return fmt.Errorf("listener %d: no address", i+1)
+		}
+		if err := checkClientAuth(l.ClientAuth); err != nil {
+			return fmt.Errorf("listener %s: %w", l.Address, err)
+		}
+		if l.Mode != "" {
+			mode, err := strconv.ParseUint(l.Mode, 8, 32)
+			if err != nil || mode > 0777 {
+				return fmt.Errorf("listener %s: invalid mode %q, expected octal permissions such as 0660", l.Address, l.Mode)
+			}
+			if !strings.HasPrefix(l.Address, "unix:") {
+				return fmt.Errorf("listener %s: mode is only for unix sockets", l.Address)
+			}
+			l.mode = os.FileMode(mode)
+		}
+		if l.Redirect != "" {
+			if l.TLS {
+				return fmt.Errorf("listener %s: redirect is only for plain HTTP listeners", l.Address)
+			}
+			if _, _, err := net.SplitHostPort(l.Redirect); err != nil {
+				return fmt.Errorf("listener %s: invalid redirect %q, expected host:port or :port", l.Address, l.Redirect)
+			}
+		}
+		if l.Open && len(l.Access) > 0 {
+			return fmt.Errorf("listener %s: open and access are exclusive", l.Address)
+		}
+		if err := compileAccess(l.Access); err != nil {
+			return fmt.Errorf("listener %s: %w", l.Address, err)
+		}
+	}
+	return nil
+}
+
+// listenersOf returns the listeners of the config, or the one of -listen and
+// -tls when there are none.
+func listenersOf(data *yamlParse) []yamlListener {
+	if len(data.Listeners) > 0 {
+		return data.Listeners
+	}
+	return []yamlListener{{Address: *listen, TLS: *enableTLS}}
+}
+
+// accessRules returns the access rules for the listener the request came in
+// on, and whether any apply.
+func accessRules(r *http.Request) ([]yamlAccess, bool) {
+	data := configOf(r)
+	if addr, ok := r.Context().Value(listenerKey{}).(string); ok {
+		for i := range data.Listeners {
+			l := &data.Listeners[i]
+			if l.Address != addr {
+				continue
+			}
+			if l.Open {
+				return nil, false
+			}
+			if len(l.Access) > 0 {
+				return l.Access, true
+			}
+		}
+	}
+	return data.Access, len(data.Access) > 0
+}
+
+// A listener with the server answering on it.
+type endpoint struct {
+	conf   yamlListener
+	ln     net.Listener
+	server *http.Server
+}
+
+// openListeners opens the sockets of the listeners and sets up a server for
+// each, answering with handler.
+func openListeners(data *yamlParse, handler http.Handler) ([]*endpoint, error) {
+	for _, l := range listenersOf(data) {
+		if l.TLS && len(serverCerts.pairs) == 0 {
+			return nil, errors.New("no certificate to listen with HTTPS, give -cert or tls certificates")
+		}
+	}
+	var endpoints []*endpoint
+	for _, l := range listenersOf(data) {
+		lns, err := openListener(&l)
+		if err != nil {
+			for _, e := range endpoints {
+				e.ln.Close()
+			}
+			return nil, err
+		}
+		h := handler
+		if l.Redirect != "" {
+			h = redirectHTTPS(l.Redirect, handler)
+		}
+		for _, ln := range lns {
+			scheme := "HTTP"
+			if l.TLS {
+				scheme = "HTTPS"
+				conf := tlsConfig.Clone()
+				if l.ClientAuth != "" {
+					conf.ClientAuth = clientAuthType(l.ClientAuth)
+				}
+				conf.NextProtos = []string{"h2", "http/1.1"}
+				ln = tls.NewListener(ln, conf)
+			}
+			mainLogger.Info("Listening with "+scheme, "address", l.Address, "socket", ln.Addr())
+			endpoints = append(endpoints, &endpoint{conf: l, ln: ln, server: newServer(l.Address, h)})
+		}
+	}
+	return endpoints, nil
+}
+
+// newServer configures the go HTTP server, the replies may take long as the
+// module zips can be large.
+func newServer(addr string, handler http.Handler) *http.Server {
+	ctx := context.WithValue(baseCtx, listenerKey{}, addr)
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+		// Requests are canceled with the upstream work on shutdown
+		BaseContext: func(net.Listener) context.Context { return ctx },
+		ErrorLog:    log.New(logWriter{newLogger("http"), levelWarn}, "", 0),
+	}
+}
+
+func openListener(l *yamlListener) ([]net.Listener, error) {
+	switch {
+	case l.Address == "systemd" || strings.HasPrefix(l.Address, "systemd:"):
+		lns := systemdListeners(strings.TrimPrefix(strings.TrimPrefix(l.Address, "systemd"), ":"))
+		if len(lns) == 0 {
+			return nil, fmt.Errorf("listener %s: no socket passed by systemd", l.Address)
+		}
+		return lns, nil
+	case strings.HasPrefix(l.Address, "unix:"):
+		file := strings.TrimPrefix(l.Address, "unix:")
+		// A socket left behind by a previous run is in the way
+		if info, err := os.Lstat(file); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(file)
+		}
+		// The socket is created with its mode, so there is no time when
+		// others may connect; the listeners are opened before serving
+		// anything, while no other files are created
+		if l.mode != 0 {
+			defer syscall.Umask(syscall.Umask(int(0777 &^ l.mode)))
+		}
+		ln, err := net.Listen("unix", file)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	ln, err := net.Listen("tcp", l.Address)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{ln}, nil
+}
+
+// The sockets passed by systemd socket activation, by name.
+var systemdSockets map[string][]net.Listener
+
+// systemdListeners returns the sockets passed by systemd with the given
+// FileDescriptorName, or all of them for an empty name.
+func systemdListeners(name string) (lns []net.Listener) {
+	if systemdSockets == nil {
+		systemdSockets = make(map[string][]net.Listener)
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		if pid != os.Getpid() {
+			fds = 0
+		}
+		const firstFD = 3
+		for i := 0; i < fds; i++ {
+			fd := firstFD + i
+			syscall.CloseOnExec(fd)
+			fdName := "unknown"
+			if i < len(names) && names[i] != "" {
+				fdName = names[i]
+			}
+			f := os.NewFile(uintptr(fd), fdName)
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				mainLogger.Warn("Skipping socket passed by systemd", "fd", fd, "err", err)
+				continue
+			}
+			systemdSockets[fdName] = append(systemdSockets[fdName], ln)
+		}
+	}
+	if name != "" {
+		return systemdSockets[name]
+	}
+	for _, l := range systemdSockets {
+		lns = append(lns, l...)
+	}
+	return
+}
+
+// redirectHTTPS sends the clients to https on the given host:port, the
+// health checks are still answered for the load balancers.
+func redirectHTTPS(target string, next http.Handler) http.Handler {
+	host, port, _ := net.SplitHostPort(target)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := host
+		if h == "" {
+			h = r.Host
+			if name, _, err := net.SplitHostPort(r.Host); err == nil {
+				h = name
+			}
+		}
+		u := *r.URL
+		u.Scheme, u.Host = "https", strings.TrimSuffix(net.JoinHostPort(h, port), ":443")
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
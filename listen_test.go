@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadListeners(t *testing.T) {
+	tests := []struct {
+		listener yamlListener
+		err      string // part of the error, none when valid
+	}{
+		{yamlListener{Address: ":8080"}, ""},
+		{yamlListener{Address: "unix:/run/goproxy.sock", Mode: "0660"}, ""},
+		{yamlListener{Address: ":80", Redirect: ":443"}, ""},
+		{yamlListener{Address: "127.0.0.1:8080", Open: true}, ""},
+		{yamlListener{}, "no address"},
+		{yamlListener{Address: ":8443", TLS: true, ClientAuth: "maybe"}, "maybe"},
+		{yamlListener{Address: "unix:/run/goproxy.sock", Mode: "rw"}, "invalid mode"},
+		{yamlListener{Address: "unix:/run/goproxy.sock", Mode: "01777"}, "invalid mode"},
+		{yamlListener{Address: ":8080", Mode: "0660"}, "only for unix sockets"},
+		{yamlListener{Address: ":8443", TLS: true, Redirect: ":443"}, "only for plain HTTP"},
+		{yamlListener{Address: ":80", Redirect: "proxy.example.com"}, "invalid redirect"},
+		{yamlListener{Address: ":8080", Open: true, Access: []yamlAccess{{}}}, "exclusive"},
+	}
+	for _, tt := range tests {
+		data := &yamlParse{Listeners: []yamlListener{tt.listener}}
+		err := data.loadListeners()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%+v: %v", tt.listener, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%+v: got error %v, want %q", tt.listener, err, tt.err)
+		}
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "goproxy.sock")
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close() // left behind, as by a crash
+
+	data := &yamlParse{
+		Access: []yamlAccess{{Modules: []string{"company.com/.*"}}},
+		Listeners: []yamlListener{
+			{Address: "unix:" + sock, Mode: "0600", Open: true},
+			{Address: "127.0.0.1:0", Access: []yamlAccess{{Modules: []string{"company.com/public/.*"}}}},
+			{Address: "localhost:0", Redirect: ":8443"},
+		},
+	}
+	if err := data.loadListeners(); err != nil {
+		t.Fatal(err)
+	}
+	current.Store(data)
+	endpoints, err := openListeners(data, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		access, ok := accessRules(r)
+		var rules []string
+		for _, a := range access {
+			rules = append(rules, a.Modules...)
+		}
+		if !ok {
+			rules = append(rules, "open")
+		}
+		w.Header().Set("X-Rules", strings.Join(rules, " "))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range endpoints {
+		go e.server.Serve(e.ln)
+		defer e.server.Close()
+	}
+	if info, err := os.Stat(sock); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("unix socket created with %v, want 0600", info.Mode().Perm())
+	}
+
+	// Each listener has its own access rules
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	tests := []struct {
+		client *http.Client
+		url    string
+		rules  string
+		status int
+	}{
+		{unixClient, "http://goproxy/company.com/x/@v/list", "open", http.StatusOK},
+		{http.DefaultClient, "http://" + endpoints[1].ln.Addr().String() + "/company.com/x/@v/list", "company.com/public/.*", http.StatusOK},
+		{noRedirect, "http://" + endpoints[2].ln.Addr().String() + "/healthz", "company.com/.*", http.StatusOK},
+		{noRedirect, "http://" + endpoints[2].ln.Addr().String() + "/company.com/x/@v/list", "", http.StatusPermanentRedirect},
+	}
+	for _, tt := range tests {
+		resp, err := tt.client.Get(tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Rules"); resp.StatusCode != tt.status || got != tt.rules {
+			t.Errorf("%s: status %d with rules %q, want %d with %q", tt.url, resp.StatusCode, got, tt.status, tt.rules)
+		}
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		target, host, want string
+	}{
+		{":443", "proxy.example.com", "https://proxy.example.com/m/@v/list?x=1"},
+		{":8443", "proxy.example.com:8080", "https://proxy.example.com:8443/m/@v/list?x=1"},
+		{"secure.example.com:443", "proxy.example.com", "https://secure.example.com/m/@v/list?x=1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://"+tt.host+"/m/@v/list?x=1", nil)
+		w := httptest.NewRecorder()
+		redirectHTTPS(tt.target, next).ServeHTTP(w, r)
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+			t.Errorf("redirect to %s from %s: %d to %s, want %s", tt.target, tt.host, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
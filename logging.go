@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Leveled logging of a message with key value pairs, in the manner of
+// log/slog which needs a newer Go.  Each part of the proxy logs as a
+// subsystem, which level can be set on its own.
+
+var (
+	logLevel  = flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error (-verbose is debug)")
+	logLevels = flag.String("log-levels", "", "Levels of subsystems differing from -log-level (example upstream=debug,cache=warn)")
+	logFormat = flag.String("log-format", "text", "Format of the log lines: text or json")
+)
+
+type level int
+
+const (
+	levelDebug level = -4
+	levelInfo  level = 0
+	levelWarn  level = 4
+	levelError level = 8
+)
+
+func (lv level) String() string {
+	switch lv {
+	case levelDebug:
+		return "DEBUG"
+	case levelInfo:
+		return "INFO"
+	case levelWarn:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+func parseLevel(s string) (level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+var logging = struct {
+	sync.Mutex
+	out        io.Writer
+	json       bool
+	min        level
+	subsystems map[string]level
+}{out: redactWriter{os.Stderr}}
+
+// setupLogging applies the log flags.  What is still written with the log
+// package, such as fatal errors, goes through the logger as well.
+func setupLogging() error {
+	min, err := parseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		min = levelDebug
+	}
+	subsystems := make(map[string]level)
+	for _, pair := range strings.Split(*logLevels, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			return fmt.Errorf("invalid -log-levels %q, expected subsystem=level", pair)
+		}
+		if subsystems[pair[:i]], err = parseLevel(pair[i+1:]); err != nil {
+			return err
+		}
+	}
+	switch *logFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown -log-format %q, expected text or json", *logFormat)
+	}
+
+	logging.Lock()
+	logging.min, logging.subsystems, logging.json = min, subsystems, *logFormat == "json"
+	logging.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(logWriter{newLogger("main"), levelError})
+	return nil
+}
+
+// A logger adds its key value pairs to the records it writes.
+type logger struct {
+	subsystem string
+	attrs     []interface{}
+}
+
+func newLogger(subsystem string) *logger {
+	return &logger{subsystem: subsystem}
+}
+
+// With returns a logger which adds the given key value pairs.
+func (l *logger) With(args ...interface{}) *logger {
+	return &logger{subsystem: l.subsystem, attrs: append(l.attrs[:len(l.attrs):len(l.attrs)], args...)}
+}
+
+// For returns the logger of another subsystem with the same pairs.
+func (l *logger) For(subsystem string) *logger {
+	return &logger{subsystem: subsystem, attrs: l.attrs}
+}
+
+func (l *logger) Enabled(lv level) bool {
+	logging.Lock()
+	defer logging.Unlock()
+	min, ok := logging.subsystems[l.subsystem]
+	if !ok {
+		min = logging.min
+	}
+	return lv >= min
+}
+
+func (l *logger) Debug(msg string, args ...interface{}) { l.log(levelDebug, msg, args) }
+func (l *logger) Info(msg string, args ...interface{})  { l.log(levelInfo, msg, args) }
+func (l *logger) Warn(msg string, args ...interface{})  { l.log(levelWarn, msg, args) }
+func (l *logger) Error(msg string, args ...interface{}) { l.log(levelError, msg, args) }
+
+func (l *logger) log(lv level, msg string, args []interface{}) {
+	if !l.Enabled(lv) {
+		return
+	}
+	pairs := append([]interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", lv.String(), "subsystem", l.subsystem, "msg", msg}, l.attrs...)
+	pairs = append(pairs, args...)
+
+	logging.Lock()
+	asJSON, out := logging.json, logging.out
+	logging.Unlock()
+
+	var b bytes.Buffer
+	if asJSON {
+		b.WriteByte('{')
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		var value interface{} = "!MISSING"
+		if i+1 < len(pairs) {
+			value = pairs[i+1]
+		}
+		if !ok {
+			key, value = "!BADKEY", pairs[i]
+			i--
+		}
+		value = logValue(value)
+		if asJSON {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			k, _ := json.Marshal(key)
+			v, err := json.Marshal(value)
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprint(value))
+			}
+			b.Write(k)
+			b.WriteByte(':')
+			b.Write(v)
+		} else {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(key)
+			b.WriteByte('=')
+			b.WriteString(quoteValue(fmt.Sprint(value)))
+		}
+	}
+	if asJSON {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	logging.Lock()
+	out.Write(b.Bytes())
+	logging.Unlock()
+}
+
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		if v == nil {
+			return nil
+		}
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// quoteValue quotes the text values which would not read as one word.
+func quoteValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// logWriter turns the lines written to a log.Logger into records.
+type logWriter struct {
+	l  *logger
+	lv level
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.l.log(w.lv, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+type loggerKey struct{}
+
+// logOf returns the logger of a subsystem for the request ctx belongs to,
+// which adds the request id.
+func logOf(ctx context.Context, subsystem string) *logger {
+	if l, ok := ctx.Value(loggerKey{}).(*logger); ok {
+		return l.For(subsystem)
+	}
+	return newLogger(subsystem)
+}
+
+// requestID returns the X-Request-ID given by the client or load balancer,
+// or a new one.
+func requestID(given string) string {
+	if len(given) > 0 && len(given) <= 64 && strings.IndexFunc(given, func(r rune) bool {
+		return !(r == '-' || r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)) || r > unicode.MaxASCII
+	}) < 0 {
+		return given
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
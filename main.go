@@ -7,7 +7,7 @@ import (
 	"flag"
 	"log"
 	"net/http"
-	"time"
+	"os"
 
 	"github.com/gorilla/mux"
 )
@@ -26,9 +26,132 @@ The Syntax of the config.yml:
 |   company.com/package-a: gitlab.com/pkg-a
 |   company.com/package-b: gitlab.com/pkg-b
 | 
-| # default git credentials to use
+| # default git credentials to use, the token may also be given as
+| # ${ENV_VARIABLE} or as file:/run/secrets/gitlab-token, or be asked for from a
+| # git credential helper with git-credential-helper: "!vault-git-helper" (files
+| # and helpers are read again in the background every 5 minutes, a helper may
+| # take 30 seconds); tokens are never logged
 | git-token: AAAAAAAAAABBBBBBBBBBBBBCCCCCCCCCCDDDDDDD
 | git-url: https://gitlab.com
+| # set to passthrough to use the basic auth credentials sent by the go command
+| # (.netrc or GOAUTH) in place of the git-token, so the git server decides access
+| git-auth: token
+| # number of (sub)groups the GitLab projects are in, ie: 3 for
+| # gitlab.corp/platform/infra/tools/thing, or probe to find the longest module
+| # path prefix which is a project with the GitLab API, the rest is the folder
+| # in the project; also for regexp rules with a replace (default: 1).  Probing
+| # is done once the client is allowed access, with its credentials for
+| # passthrough, and for at most max-group-depth groups (default: 4)
+| group-depth: probe
+| max-group-depth: 4
+| # connections to the git server, a rule with its own git-url may have its own
+| # transport, otherwise this one is used.  The server certificate (-cert) is
+| # not sent, give a client-cert for mutual TLS.
+| transport:
+|   ca-file: /etc/pki/corp-ca.pem   # default: the -CA bundle
+|   client-cert: /etc/goproxy/client.pem
+|   client-key: /etc/goproxy/client.key
+|   proxy: http://proxy.corp:3128   # or none (default: from HTTPS_PROXY)
+|   timeout: 30s                    # to connect and get the reply (default: 1m)
+|   idle-timeout: 90s
+|   max-conns-per-host: 32
+|   max-idle-conns: 16
+|   # where the archive links handed out by the git server may point to,
+|   # besides the git server and its subdomains (and for GitHub
+|   # codeload.github.com and *.githubusercontent.com)
+|   egress: ["archives.corp"]
+| 
+| # directory for caching tarballs and the generated .zip, .mod and .info files,
+| # upper case letters in module paths and versions are stored escaped as in
+| # the cache of the go command (ie: !azure for Azure)
+| local-cache: /var/cache/goproxy
+| 
+| # append-only record of the commit and h1: hash served for each module@version,
+| # a moved tag is refused (or only logged with the alert policy) until accepted
+| # with: goproxy ledger accept module@version
+| ledger: /var/lib/goproxy/ledger.jsonl
+| ledger-policy: refuse
+| 
+| # JSON lines audit log of every request (client, module, version, commit,
+| # cache hit, bytes and status), rotated at the size in MB, and/or sent to
+| # syslog (local or ie: udp://loghost:514)
+| audit-log: /var/log/goproxy/audit.jsonl
+| audit-log-max-size: 100
+| audit-log-backups: 10
+| audit-syslog: local
+| 
+| # TLS settings of the server (-tls).  TLS 1.3 is always enabled; the default
+| # ciphers for TLS 1.2 clients are the forward secret ECDHE AEAD suites.  The
+| # certificates are read in again when their files change, the ones here are
+| # used besides -cert for the names clients ask for (SNI).  A warning is
+| # logged for certificates expiring soon.
+| tls:
+|   min-version: "1.2"              # or "1.3"
+|   ciphers: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384]
+|   certificates:
+|   - cert: /etc/goproxy/proxy2.pem
+|     key: /etc/goproxy/proxy2.key
+|   expiry-warning: 336h            # 14 days (default)
+| 
+| # verify client certificates (none, request or require) against the CAs
+| # of the client-ca file, which is needed then; the -CA bundle is only for
+| # the servers
+| client-auth: require
+| client-ca: /etc/goproxy/clients-ca.pem
+| 
+| # trusted issuers of OIDC bearer tokens (ie: GitLab CI id_tokens or GitHub
+| # Actions), the token claims can then be used in the access rules; the
+| # audience is required, tokens must name it in their aud claim
+| oidc:
+| - issuer: https://gitlab.com
+|   audience: https://goproxy.company.com
+|   jwks-url: https://gitlab.com/oauth/discovery/keys
+| - issuer: https://token.actions.githubusercontent.com
+|   audience: goproxy
+|   jwks-file: /etc/goproxy/github-jwks.json
+| 
+| # limit which modules a client may read, the first rule matching both the
+| # client and the module decides; identities are client certificate patterns,
+| # client addresses, bearer tokens (or .netrc passwords) and OIDC token
+| # claims.  Module patterns match, ignoring case, the module path, the path it
+| # is mapped to and the repository on the git server (ie:
+| # gitlab.company.com/security/tool), so a repository is covered by its rules
+| # whatever module path it is asked for by.  Denied modules are reported as
+| # not found.
+| access:
+| - cert-ou: "Security"
+|   cidr: ["10.20.0.0/16"]
+|   modules: ["company.com/security/.*"]
+| - deny: true
+|   modules: ["company.com/security/.*"]
+| - tokens: ["build-agent-secret"]
+| - claims:
+|     project_path: "platform/.*"
+|     ref_protected: "true"
+| - cert-subject: "CN=.*,OU=Developers,O=Company"
+|   cert-san: ".*\\.build\\.company\\.com"
+|   modules: ["company.com/package-.*"]
+| 
+| # where to listen, instead of -listen and -tls; each listener may verify
+| # client certificates its own way and have access rules of its own instead
+| # of the ones above, or none for trusted clients (open).  Unix sockets get
+| # the permissions of mode, systemd takes the sockets of socket activation (by
+| # FileDescriptorName with systemd:name).  A plain HTTP listener can redirect
+| # the clients to https on host:port, or :port of the host asked for.
+| listeners:
+| - address: ":8443"
+|   tls: true
+|   client-auth: request
+| - address: ":8080"
+|   redirect: ":8443"
+| - address: "127.0.0.1:8081"
+|   open: true
+| - address: unix:/run/goproxy/goproxy.sock
+|   mode: "0660"
+|   access:
+|   - tokens: ["${SIDECAR_TOKEN}"]
+| - address: systemd:goproxy
+|   tls: true
 | 
 | regexp:
 | - match: "mytest.domain.A/([^/*])"
@@ -36,24 +159,81 @@ The Syntax of the config.yml:
 |   git-token: AAAAAAAAAABBBBBBBBBBBBBCCCCCCCCCCDDDDDDD
 |   git-url: https://another.domain
 |   # alternate domain can be substituted with a regexp match and replace
+| - match: "^company.com/(?P<team>[^/]+)/(?P<repo>[^/]+)"
+|   base: gitlab.company.com
+|   group: "platform/teams/${team}"
+|   repo: "${repo}"
+|   # or set the host, group (with any depth of subgroups), repo and path
+|   # folder in the repo from the match, the rest of the module path is the
+|   # folder when no path is given
+| - prefix: company.com/platform
+|   replace: gitlab.corp/platform/go
+|   name: platform
+|   # prefix rules match whole path elements and are found with a lookup
+|   # table, so there may be thousands of them; the longest prefix is used
+|   # and regexp rules are only tried when no prefix matches, unless they have
+|   # a higher priority (default 0).  The rule used is named in the
+|   # X-Goproxy-Rule header of the reply when the lookup subsystem logs at
+|   # debug level.
 | - match: "github.com.*"
+|   priority: 10
 |   git-token: AAAAAAAAAABBBBBBBBBBBBBCCCCCCCCCCDDDDDDD
+|   # more tokens used in turn, the next one is used when the rate limit of a
+|   # token is reached; failed calls are retried, and when every token is used
+|   # up the go command gets a 503 with Retry-After
+|   git-tokens: ["${GITHUB_TOKEN_2}", file:/run/secrets/github-token-3]
 |   git-url: https://github.com
 |   # without a replace, the original url is used with the provided token
+| 
+| # expected mappings, checked whenever the config is loaded; a failing test
+| # stops the config from being used
+| tests:
+| - module: company.com/package-a/sub
+|   repo: gitlab.com/pkg-a
+|   path: sub
+| - module: mytest.domain.A/x
+|   git-url: https://another.domain
+| - module: unknown.org/pkg
+|   not-found: true
+| - module: company.com/platform/billing
+|   rule: platform
 `
 
-	listen         = flag.String("listen", ":8080", "Where to listen to incoming connections (example 1.2.3.4:8080)")
-	enableTLS      = flag.Bool("tls", false, "Enforce TLS secure transport on incoming connections")
-	verbose        = flag.Bool("verbose", false, "Turn on verbose")
+	listen         = flag.String("listen", ":8080", "Where to listen to incoming connections (example 1.2.3.4:8080, unix:/run/goproxy.sock or systemd), unless the config has listeners")
+	enableTLS      = flag.Bool("tls", false, "Enforce TLS secure transport on incoming connections of -listen")
+	verbose        = flag.Bool("verbose", false, "Log at the debug level, same as -log-level debug")
+	adminListen    = flag.String("admin", "", "Where to serve the admin endpoints such as /metrics (example 127.0.0.1:9090)")
 	compileVersion = "SELF BUILT"
-	usage          = "[options]"
+	usage          = "[options] [check-config | resolve module[@version] | ledger list|pending|accept module@version... | selftest [-go go] [-git git] [-keep]]"
 )
 
 func main() {
 	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
 	loadTLS()
+
+	switch flag.Arg(0) {
+	case "check-config":
+		os.Exit(checkConfig())
+	case "resolve":
+		resolveCommand(flag.Args()[1:])
+		return
+	case "selftest":
+		os.Exit(selftestCommand(flag.Args()[1:]))
+	}
 	loadConfig()
 
+	switch flag.Arg(0) {
+	case "":
+	case "ledger":
+		ledgerCommand(flag.Args()[1:])
+		return
+	default:
+		log.Fatal("Unknown command ", flag.Arg(0))
+	}
+
 	// setup server for proxying packages
 	router := mux.NewRouter()
 	router.HandleFunc("/{module:.+}/@v/list", list).Methods(http.MethodGet)
@@ -66,21 +246,22 @@ func main() {
 	// setup server for summing packages
 	router.HandleFunc("/lookup/{module:.+}@{version}", sum).Methods(http.MethodGet)
 
-	http.Handle("/", router)
-	// Configure the go HTTP server
-	server := &http.Server{
-		Addr:           *listen,
-		TLSConfig:      tlsConfig,
-		ReadTimeout:    10 * time.Hour,
-		WriteTimeout:   10 * time.Hour,
-		MaxHeaderBytes: 1 << 20,
+	http.Handle("/", withConfig(auditLog(accessControl(router))))
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
+	endpoints, err := openListeners(config(), http.DefaultServeMux)
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	if *enableTLS {
-		log.Println("Listening with HTTPS on", *listen)
-		log.Fatal(server.ListenAndServeTLS(*certFile, *keyFile))
-	} else {
-		log.Println("Listening with HTTP on", *listen)
-		log.Fatal(server.ListenAndServe())
+	watchReload()
+	if *adminListen != "" {
+		startAdmin(*adminListen)
+	}
+	for _, e := range endpoints {
+		if e.conf.TLS {
+			watchCertificates()
+			break
+		}
 	}
+	serve(endpoints)
 }
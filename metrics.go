@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small hand-rolled set of metrics written in the Prometheus text
+// exposition format.  Each metric keeps its values by the joined label values.
+type metric struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64 // histograms only
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64  // counter or gauge value, or the sum of a histogram
+	counts []uint64 // histogram bucket counts
+	count  uint64
+}
+
+var metrics []*metric
+
+func newMetric(typ, name, help string, labels ...string) *metric {
+	m := &metric{name: name, help: help, typ: typ, labels: labels, values: make(map[string]*metricValue)}
+	if typ == "histogram" {
+		m.buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+	}
+	if len(labels) == 0 {
+		m.get(nil) // always report metrics without labels
+	}
+	metrics = append(metrics, m)
+	return m
+}
+
+func (m *metric) get(lv []string) *metricValue {
+	key := strings.Join(lv, "\xff")
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{labels: lv}
+		if m.buckets != nil {
+			v.counts = make([]uint64, len(m.buckets))
+		}
+		m.values[key] = v
+	}
+	return v
+}
+
+// add increases a counter or gauge.
+func (m *metric) add(delta float64, lv ...string) {
+	m.mu.Lock()
+	m.get(lv).value += delta
+	m.mu.Unlock()
+}
+
+// set sets a gauge.
+func (m *metric) set(value float64, lv ...string) {
+	m.mu.Lock()
+	m.get(lv).value = value
+	m.mu.Unlock()
+}
+
+// observe records a value in a histogram.
+func (m *metric) observe(value float64, lv ...string) {
+	m.mu.Lock()
+	v := m.get(lv)
+	for i, b := range m.buckets {
+		if value <= b {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.value += value
+	m.mu.Unlock()
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := m.values[k]
+		if m.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labelString(m.labels, v.labels, "", ""), formatFloat(v.value))
+			continue
+		}
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, v.labels, "le", formatFloat(b)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, v.labels, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelString(m.labels, v.labels, "", ""), formatFloat(v.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelString(m.labels, v.labels, "", ""), v.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	metricRequests = newMetric("counter", "goproxy_requests_total",
+		"Requests handled by kind and status.", "kind", "status")
+	metricRequestDuration = newMetric("histogram", "goproxy_request_duration_seconds",
+		"Time taken to reply by kind of request.", "kind")
+	metricBytes = newMetric("counter", "goproxy_response_bytes_total",
+		"Bytes sent to clients by kind of request.", "kind")
+	metricCache = newMetric("counter", "goproxy_cache_requests_total",
+		"Requests answered from the local cache (hit) or upstream (miss).", "result")
+	metricCacheSize = newMetric("gauge", "goproxy_cache_size_bytes",
+		"Size of the local cache directory.")
+	metricUpstream = newMetric("counter", "goproxy_upstream_requests_total",
+		"Calls to the git servers by provider, host and status code.", "provider", "host", "status")
+	metricUpstreamDuration = newMetric("histogram", "goproxy_upstream_request_duration_seconds",
+		"Time until the git servers replied, by provider and host.", "provider", "host")
+	metricUpstreamErrors = newMetric("counter", "goproxy_upstream_errors_total",
+		"Failed calls to the git servers, by provider and host.", "provider", "host")
+	metricRateLimit = newMetric("gauge", "goproxy_upstream_ratelimit_remaining",
+		"API rate limit remaining as last reported by the git server.", "provider", "host")
+	metricCertExpiry = newMetric("gauge", "goproxy_tls_certificate_expiry_seconds",
+		"Time left until the server certificate expires, by certificate file.", "file")
+	metricConversions = newMetric("gauge", "goproxy_archive_conversions_in_flight",
+		"Tarballs currently being converted into module zips.")
+	metricAbandoned = newMetric("counter", "goproxy_abandoned_total",
+		"Work stopped as the client went away (canceled) or it took too long (timeout), by operation.", "operation", "reason")
+)
+
+// abandoned records an operation stopped because ctx is done.
+func abandoned(ctx context.Context, operation string) {
+	switch ctx.Err() {
+	case context.Canceled:
+		metricAbandoned.add(1, operation, "canceled")
+	case context.DeadlineExceeded:
+		metricAbandoned.add(1, operation, "timeout")
+	}
+}
+
+// observeRequest records the metrics of a finished request.
+func observeRequest(rec *auditRecord, elapsed time.Duration) {
+	metricRequests.add(1, rec.Kind, strconv.Itoa(rec.Status))
+	metricRequestDuration.observe(elapsed.Seconds(), rec.Kind)
+	metricBytes.add(float64(rec.Bytes), rec.Kind)
+	if rec.Cache != "" {
+		metricCache.add(1, rec.Cache)
+	}
+}
+
+// upstreamTransport records the metrics of the calls made to a git server.
+type upstreamTransport struct {
+	provider string
+	base     http.RoundTripper
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultClient.Transport
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	host := req.URL.Host
+	elapsed := time.Since(start)
+	metricUpstreamDuration.observe(elapsed.Seconds(), t.provider, host)
+	if l := logOf(req.Context(), "upstream"); l.Enabled(levelDebug) {
+		l.Debug("Called git server", "provider", t.provider, "method", req.Method, "url", req.URL.Redacted(),
+			"status", describe(resp, err), "duration", elapsed.Round(time.Millisecond))
+	}
+	if err != nil {
+		metricUpstreamErrors.add(1, t.provider, host)
+		if t.provider != "archive" && req.Context().Err() != nil { // archive downloads count as a fetch
+			abandoned(req.Context(), "api")
+		}
+		return resp, err
+	}
+	metricUpstream.add(1, t.provider, host, strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		metricUpstreamErrors.add(1, t.provider, host)
+	}
+	for _, h := range []string{"RateLimit-Remaining", "X-RateLimit-Remaining"} {
+		if v := resp.Header.Get(h); v != "" {
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				metricRateLimit.set(n, t.provider, host)
+			}
+		}
+	}
+	return resp, nil
+}
+
+// The cache size is found by walking the cache, so it is only done once in a
+// while.
+var cacheSize struct {
+	sync.Mutex
+	checked time.Time
+}
+
+func updateCacheSize() {
+	dir := config().LocalCache
+	if dir == "" {
+		return
+	}
+	cacheSize.Lock()
+	defer cacheSize.Unlock()
+	if time.Since(cacheSize.checked) < time.Minute {
+		return
+	}
+	cacheSize.checked = time.Now()
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	metricCacheSize.set(float64(total))
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	updateCacheSize()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// startAdmin serves the admin endpoints on their own listener, so they are
+// not exposed to the module clients.
+var adminServer *http.Server
+
+func startAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyzDetails)
+	mainLogger.Info("Admin endpoints listening", "address", addr)
+	adminServer = &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog: log.New(logWriter{newLogger("admin"), levelWarn}, "", 0)}
+	go func() {
+		if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
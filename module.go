@@ -3,53 +3,70 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path"
 	"strings"
 
 	"github.com/google/go-github/v50/github"
-	"github.com/gorilla/mux"
 	"github.com/xanzy/go-gitlab"
 )
 
 func mod(w http.ResponseWriter, r *http.Request) {
-	if *verbose {
-		log.Printf("Got module request: %#v  module: %q", r.RequestURI, mux.Vars(r)["module"])
-	}
 	// find a project ID by module name
-	module := mux.Vars(r)["module"]
-	lr, ok := Lookup(module)
+	module, version, ok := requestModule(w, r)
+	if !ok {
+		return
+	}
+	lr, ok := lookup(w, r, module)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	if !useClientCredentials(w, r, lr) {
+		return
+	}
 
-	ver, notice := getVersion(lr, mux.Vars(r)["version"])
+	ver, notice, err := getVersion(r.Context(), lr, version)
+	if err != nil {
+		upstreamError(w, err)
+		return
+	}
 	if notice != "" {
 		http.Error(w, notice, http.StatusNotFound)
 		return
 	}
+	auditOf(r).version(&ver)
+
+	if a, ok := cachedArtifacts(lr, module, ver.Version); ok &&
+		serveArtifact(w, r, a.mod, "text/plain; charset=utf-8") {
+		auditOf(r).cache(true)
+		return
+	}
 
 	if ver.cachePath != "" { // Use cache if we got it!
 		if fh, err := os.Open(ver.cachePath); err == nil {
 			defer fh.Close()
 			gz, err := gzip.NewReader(fh)
 			if err != nil {
-				log.Println("error reading gzip", ver.cachePath)
+				logOf(r.Context(), "cache").Error("Error reading cached archive", "file", ver.cachePath, "err", err)
 				return
 			}
 			tr := tar.NewReader(gz)
+			gomods := make(map[string][]byte)
 			var item *tar.Header
 			for item, err = tr.Next(); err == nil; item, err = tr.Next() {
-				if parts := strings.SplitN(item.Name, "/", 2); len(parts) > 1 {
-					if dn, fn := path.Split(parts[1]); dn == lr.cleanPath && fn == "go.mod" {
-						io.Copy(w, tr)
-						return
-					}
+				if parts := strings.SplitN(item.Name, "/", 2); len(parts) > 1 && path.Base(parts[1]) == "go.mod" {
+					gomods[path.Dir(parts[1])], _ = io.ReadAll(tr)
+				}
+			}
+			for _, folder := range lr.folders() {
+				if gomod, ok := gomods[path.Clean(folder)]; ok {
+					w.Write(gomod)
+					return
 				}
 			}
 			fmt.Fprintf(w, "module %s\n", lr.orig)
@@ -57,11 +74,23 @@ func mod(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	ctx, cancel := context.WithTimeout(r.Context(), *apiTimeout)
+	defer cancel()
 	switch client := lr.git.(type) {
 	case *gitlab.Client:
-		content, _, err := client.RepositoryFiles.GetRawFile(lr.groupRepo, path.Join(lr.cleanPath, "go.mod"), &gitlab.GetRawFileOptions{
-			Ref: &ver.Origin.Hash,
-		})
+		var content []byte
+		for _, folder := range lr.folders() {
+			content, _, err = client.RepositoryFiles.GetRawFile(lr.groupRepo, path.Join(folder, "go.mod"), &gitlab.GetRawFileOptions{
+				Ref: &ver.Origin.Hash,
+			}, gitlab.WithContext(ctx))
+			if err == nil || upstreamFailed(ctx, err) {
+				break
+			}
+		}
+		if upstreamFailed(ctx, err) {
+			upstreamError(w, err)
+			return
+		}
 		if err != nil {
 			fmt.Fprintf(w, "module %s\n", lr.baseGroupRepo)
 			return
@@ -70,8 +99,18 @@ func mod(w http.ResponseWriter, r *http.Request) {
 		// write go.mod in output
 		io.WriteString(w, string(content))
 	case *github.Client:
-		content, _, err := client.Repositories.DownloadContents(ctx, lr.group, lr.repo, path.Join(lr.cleanPath, "go.mod"),
-			&github.RepositoryContentGetOptions{Ref: ver.Origin.Hash})
+		var content io.ReadCloser
+		for _, folder := range lr.folders() {
+			content, _, err = client.Repositories.DownloadContents(ctx, lr.group, lr.repo, path.Join(folder, "go.mod"),
+				&github.RepositoryContentGetOptions{Ref: ver.Origin.Hash})
+			if err == nil || upstreamFailed(ctx, err) {
+				break
+			}
+		}
+		if upstreamFailed(ctx, err) {
+			upstreamError(w, err)
+			return
+		}
 		if err != nil {
 			fmt.Fprintf(w, "module %s\n", lr.orig)
 			return
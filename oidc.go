@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A trusted issuer of OIDC tokens, such as the GitLab CI id_tokens or the
+// GitHub Actions OIDC provider.  The signing keys are read from a local JWKS
+// file or fetched from the JWKS URL.
+type yamlOIDC struct {
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	JWKSFile string `yaml:"jwks-file"`
+	JWKSURL  string `yaml:"jwks-url"`
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// How long fetched keys are used before asking the issuer again, and how
+// often an unknown key id may trigger a fetch.
+const (
+	jwksRefresh = time.Hour
+	jwksRetry   = time.Minute
+	jwksTimeout = 10 * time.Second
+	jwtLeeway   = time.Minute
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var oidcLogger = newLogger("oidc")
+
+func (data *yamlParse) loadOIDC() error {
+	for i := range data.OIDC {
+		o := &data.OIDC[i]
+		if o.Issuer == "" {
+			return errors.New("oidc entry without an issuer")
+		}
+		if o.Audience == "" {
+			// Without it any token of the issuer would do, even the ones
+			// meant for other services
+			return fmt.Errorf("oidc issuer %s needs an audience", o.Issuer)
+		}
+		if (o.JWKSFile == "") == (o.JWKSURL == "") {
+			return fmt.Errorf("oidc issuer %s needs one of jwks-file or jwks-url", o.Issuer)
+		}
+		if o.JWKSFile != "" {
+			keys, err := o.loadKeys()
+			if err != nil {
+				return fmt.Errorf("error loading keys for %s: %w", o.Issuer, err)
+			}
+			o.keys = keys
+		}
+		oidcLogger.Debug("Trusting OIDC tokens", "issuer", o.Issuer, "audience", o.Audience)
+	}
+	return nil
+}
+
+// loadKeys reads in the JWKS from the file or URL.
+func (o *yamlOIDC) loadKeys() (map[string]crypto.PublicKey, error) {
+	var raw []byte
+	var err error
+	if o.JWKSFile != "" {
+		raw, err = os.ReadFile(o.JWKSFile)
+	} else {
+		raw, err = fetchJWKS(o.JWKSURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			oidcLogger.Warn("Skipping key", "kid", k.Kid, "issuer", o.Issuer, "err", err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(baseCtx, jwksTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the signing key with the given id, fetching the keys again
+// when they are stale or the id is unknown.  The keys are fetched without
+// holding the lock, the other requests meanwhile use the ones already known.
+func (o *yamlOIDC) key(kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	pub, ok := o.keys[kid]
+	age := time.Since(o.fetched)
+	fetch := o.JWKSURL != "" && (age > jwksRefresh || (!ok && age > jwksRetry))
+	if fetch {
+		o.fetched = time.Now()
+	}
+	o.mu.Unlock()
+	if fetch {
+		keys, err := o.loadKeys()
+		if err != nil {
+			oidcLogger.Error("Error fetching keys", "issuer", o.Issuer, "err", err)
+		} else {
+			o.mu.Lock()
+			o.keys = keys
+			o.mu.Unlock()
+			pub, ok = keys[kid]
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return pub, nil
+}
+
+var errNotJWT = errors.New("not a JWT")
+
+// verifyJWT checks the signature and validity of a token from one of the
+// trusted issuers and returns its claims.
+func verifyJWT(data *yamlParse, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errNotJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errNotJWT
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errNotJWT
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errNotJWT
+	}
+
+	iss, _ := claims["iss"].(string)
+	var o *yamlOIDC
+	for i := range data.OIDC {
+		if data.OIDC[i].Issuer == iss {
+			o = &data.OIDC[i]
+			break
+		}
+	}
+	if o == nil {
+		return nil, fmt.Errorf("untrusted issuer %q", iss)
+	}
+	pub, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Alg, pub, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if !matchClaim(claims["aud"], func(v string) bool { return v == o.Audience }) {
+		return nil, fmt.Errorf("token not for audience %q", o.Audience)
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func verifySignature(alg string, pub crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	var h crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	hasher := h.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, h, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(key, h, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" {
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return errors.New("invalid signature")
+			}
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("alg %q does not match key", alg)
+}
+
+// matchClaim reports whether the claim, or any element of a list claim,
+// satisfies the test.
+func matchClaim(claim interface{}, test func(string) bool) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case string:
+		return test(v)
+	case []interface{}:
+		for _, e := range v {
+			if matchClaim(e, test) {
+				return true
+			}
+		}
+		return false
+	case float64:
+		return test(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return test(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT makes an ES256 token with the key.
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+	seg := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := seg(header) + "." + seg(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &yamlParse{OIDC: []yamlOIDC{{
+		Issuer:   "https://gitlab.com",
+		Audience: "goproxy",
+		JWKSFile: "jwks.json", // the keys are never read again
+		keys:     map[string]crypto.PublicKey{"k1": &key.PublicKey},
+		fetched:  time.Now(),
+	}}}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://gitlab.com", "aud": "goproxy",
+			"exp": now + 300, "sub": "project_path:grp/repo"}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	es256 := map[string]interface{}{"alg": "ES256", "kid": "k1"}
+	parts := strings.Split(signJWT(t, key, es256, claims(nil)), ".")
+	raw, _ := json.Marshal(claims(map[string]interface{}{"sub": "project_path:other/repo"}))
+	parts[1] = base64.RawURLEncoding.EncodeToString(raw)
+	tampered := strings.Join(parts, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   string // empty when valid
+	}{
+		{"valid", signJWT(t, key, es256, claims(nil)), ""},
+		{"audience list", signJWT(t, key, es256, claims(map[string]interface{}{"aud": []string{"other", "goproxy"}})), ""},
+		{"within leeway", signJWT(t, key, es256, claims(map[string]interface{}{"exp": now - 30, "nbf": now + 30})), ""},
+		{"other audience", signJWT(t, key, es256, claims(map[string]interface{}{"aud": "other"})), "audience"},
+		{"no audience", signJWT(t, key, es256, claims(map[string]interface{}{"aud": nil})), "audience"},
+		{"expired", signJWT(t, key, es256, claims(map[string]interface{}{"exp": now - 600})), "expired"},
+		{"no expiry", signJWT(t, key, es256, claims(map[string]interface{}{"exp": nil})), "expired"},
+		{"not yet valid", signJWT(t, key, es256, claims(map[string]interface{}{"nbf": now + 600})), "not yet valid"},
+		{"untrusted issuer", signJWT(t, key, es256, claims(map[string]interface{}{"iss": "https://evil.com"})), "untrusted issuer"},
+		{"unknown key", signJWT(t, key, map[string]interface{}{"alg": "ES256", "kid": "k2"}, claims(nil)), "unknown key"},
+		{"other key", signJWT(t, other, es256, claims(nil)), "invalid signature"},
+		{"tampered claims", tampered, "invalid signature"},
+		{"alg of another key type", signJWT(t, key, map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims(nil)), "does not match"},
+		{"alg none", signJWT(t, key, map[string]interface{}{"alg": "none", "kid": "k1"}, claims(nil)), "unsupported alg"},
+		{"not a JWT", "secret-token", errNotJWT.Error()},
+		{"bad segment", "e30.!!!.e30", errNotJWT.Error()},
+	}
+	for _, tt := range tests {
+		_, err := verifyJWT(data, tt.token)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
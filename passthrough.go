@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+// How long a successful permission check of a user on a repository is
+// trusted before the git server is asked again.
+const permissionTTL = 5 * time.Minute
+
+// A git client built from the credentials of a client, along with the
+// repositories the credentials were found to have access to.
+type userClient struct {
+	git      interface{}
+	used     time.Time
+	repos    map[string]time.Time
+	projects projectCache // probed with the credentials
+}
+
+var (
+	userClientsMu sync.Mutex
+	userClients   = make(map[string]*userClient)
+)
+
+func checkGitAuth(auth string) error {
+	switch auth {
+	case "", "token", "passthrough":
+		return nil
+	}
+	return fmt.Errorf("unknown git-auth %q, expected token or passthrough", auth)
+}
+
+// useClientCredentials swaps the shared git client of the lookup for one
+// using the credentials sent with the request, when the matching rule asks for
+// pass-through.  The git server then decides what the client may read.  The
+// GitLab subgroups are then probed for with the client used.  When false is
+// returned a reply has already been sent.
+func useClientCredentials(w http.ResponseWriter, r *http.Request, lr *lookupResult) bool {
+	if !lr.passthrough {
+		lr.probeGroups(r.Context())
+		return true
+	}
+	_, token, ok := r.BasicAuth()
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="goproxy"`)
+		http.Error(w, "git credentials required", http.StatusUnauthorized)
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(lr.gitProvider + "\x00" + lr.gitURL + "\x00" + token))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	userClientsMu.Lock()
+	uc, found := userClients[key]
+	if !found {
+		// Forget the clients which have not been used for a while
+		for k, c := range userClients {
+			if now.Sub(c.used) > time.Hour {
+				delete(userClients, k)
+			}
+		}
+		git, err := login([]*secret{plainSecret(token)}, lr.gitURL, lr.gitProvider, lr.backend)
+		if err != nil {
+			userClientsMu.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		uc = &userClient{git: git, repos: make(map[string]time.Time)}
+		userClients[key] = uc
+	}
+	uc.used = now
+	userClientsMu.Unlock()
+
+	lr.git, lr.projects = uc.git, &uc.projects
+	lr.probeGroups(r.Context())
+	userClientsMu.Lock()
+	checked, isChecked := uc.repos[lr.groupRepo]
+	userClientsMu.Unlock()
+	if isChecked && now.Sub(checked) < permissionTTL {
+		return true
+	}
+
+	// Re-authorize, as the content may come from the cache without asking
+	// the git server
+	if !canRead(r.Context(), uc.git, lr) {
+		logOf(r.Context(), "access").Debug("Git server denied the client", "repo", lr.groupRepo, "client", r.RemoteAddr)
+		http.NotFound(w, r)
+		return false
+	}
+	userClientsMu.Lock()
+	uc.repos[lr.groupRepo] = now
+	userClientsMu.Unlock()
+	return true
+}
+
+// canRead does a cheap call to check the client may read the repository.
+func canRead(ctx context.Context, git interface{}, lr *lookupResult) bool {
+	ctx, cancel := context.WithTimeout(ctx, *apiTimeout)
+	defer cancel()
+	switch client := git.(type) {
+	case *gitlab.Client:
+		_, _, err := client.Projects.GetProject(lr.groupRepo, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
+		return err == nil
+	case *github.Client:
+		_, _, err := client.Repositories.Get(ctx, lr.group, lr.repo)
+		return err == nil
+	}
+	return false
+}
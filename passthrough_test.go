@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUseClientCredentials(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasPrefix(r.URL.Path, "/api/v4/projects/") {
+			return // go-gitlab asks for the rate limit first
+		}
+		calls++
+		if r.Header.Get("PRIVATE-TOKEN") != "reader" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "404 Project Not Found"}`))
+			return
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer srv.Close()
+	t.Cleanup(func() { userClients = make(map[string]*userClient) })
+
+	steps := []struct {
+		token  string // sent as the password, none when empty
+		status int    // of the reply, 0 when the request may go on
+		calls  int    // to check the permission
+	}{
+		{"", http.StatusUnauthorized, 0},
+		{"reader", 0, 1},
+		{"reader", 0, 0}, // checked a moment ago
+		{"other", http.StatusNotFound, 1},
+		{"other", http.StatusNotFound, 1}, // denials are not remembered
+	}
+	for i, s := range steps {
+		calls = 0
+		lr := &lookupResult{passthrough: true, gitURL: srv.URL, gitProvider: "gitlab",
+			group: "grp", repo: "repo", groupRepo: "grp/repo", git: struct{}{}}
+		r := httptest.NewRequest("GET", "/company.com/grp/repo/@v/list", nil)
+		if s.token != "" {
+			r.SetBasicAuth("user", s.token)
+		}
+		w := httptest.NewRecorder()
+		ok := useClientCredentials(w, r, lr)
+		switch {
+		case ok != (s.status == 0):
+			t.Errorf("step %d: allowed %t, reply %d", i+1, ok, w.Code)
+		case !ok && w.Code != s.status:
+			t.Errorf("step %d: reply %d, want %d", i+1, w.Code, s.status)
+		case ok && lr.git == struct{}{}:
+			t.Errorf("step %d: the shared git client is used", i+1)
+		}
+		if s.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("step %d: no WWW-Authenticate header", i+1)
+		}
+		if calls != s.calls {
+			t.Errorf("step %d: %d calls to the git server, want %d", i+1, calls, s.calls)
+		}
+	}
+	if len(userClients) != 2 {
+		t.Errorf("%d clients kept, want one per token", len(userClients))
+	}
+}
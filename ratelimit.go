@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+// How calls to the git APIs are retried.  Longer waits than maxRetryWait are
+// left to the client, which gets a 503 with Retry-After.
+const (
+	maxRetries   = 3
+	maxRetryWait = 10 * time.Second
+	retryBackoff = 500 * time.Millisecond
+)
+
+// Replies with an ETag are kept, up to this size and number, to make
+// conditional requests which do not count against the rate limit.
+const (
+	etagMaxBody    = 1 << 20
+	etagMaxEntries = 1000
+)
+
+// rateLimitError is returned when every token for a git server is over its
+// rate limit, or the server asks to be called again later than maxRetryWait.
+type rateLimitError struct {
+	host       string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit of %s exhausted, retry in %s", e.host, e.retryAfter.Round(time.Second))
+}
+
+func rateLimited(err error) bool {
+	var limited *rateLimitError
+	return errors.As(err, &limited)
+}
+
+// upstreamFailed tells whether the git server could not answer, as opposed
+// to answering an error such as not found.
+func upstreamFailed(ctx context.Context, err error) bool {
+	return err != nil && (ctx.Err() != nil || rateLimited(err))
+}
+
+// upstreamError replies to a request which failed on the git server, with a
+// 503 and Retry-After when the rate limit is used up, a 504 when it took too
+// long, or a 404 when the git server does not know the repository.
+func upstreamError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	if upstreamStatus(err) == http.StatusNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		secs := int(math.Ceil(limited.retryAfter.Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// upstreamStatus returns the status the git API answered a failed call with,
+// or 0 when there was no answer.
+func upstreamStatus(err error) int {
+	var glErr *gitlab.ErrorResponse
+	if errors.As(err, &glErr) && glErr.Response != nil {
+		return glErr.Response.StatusCode
+	}
+	var ghErr *github.ErrorResponse
+	if errors.As(err, &ghErr) && ghErr.Response != nil {
+		return ghErr.Response.StatusCode
+	}
+	return 0
+}
+
+// tokenPool hands out the tokens for a git server in turn, skipping the ones
+// over their rate limit until it resets.
+type tokenPool struct {
+	mu     sync.Mutex
+	tokens []*secret
+	until  []time.Time
+	next   int
+}
+
+func newTokenPool(tokens []*secret) *tokenPool {
+	p := &tokenPool{}
+	for _, tok := range tokens {
+		if tok != nil {
+			p.tokens = append(p.tokens, tok)
+		}
+	}
+	if len(p.tokens) == 0 {
+		p.tokens = []*secret{nil} // anonymous calls are limited too
+	}
+	p.until = make([]time.Time, len(p.tokens))
+	return p
+}
+
+// pick returns the index of the next token to use, or -1 and how long until
+// one is usable again.
+func (p *tokenPool) pick() (int, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for n := range p.tokens {
+		i := (p.next + n) % len(p.tokens)
+		if d := p.until[i].Sub(now); d > 0 {
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		p.next = i + 1
+		return i, 0
+	}
+	return -1, wait
+}
+
+func (p *tokenPool) limit(i int, until time.Time) {
+	p.mu.Lock()
+	p.until[i] = until
+	p.mu.Unlock()
+}
+
+// wait returns how long until the token can be used again.
+func (p *tokenPool) wait(i int) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Until(p.until[i])
+}
+
+type etagEntry struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+type etagCache struct {
+	sync.Mutex
+	m map[string]*etagEntry
+}
+
+func (c *etagCache) get(key string) *etagEntry {
+	c.Lock()
+	defer c.Unlock()
+	return c.m[key]
+}
+
+func (c *etagCache) put(key string, e *etagEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]*etagEntry)
+	}
+	if _, ok := c.m[key]; !ok && len(c.m) >= etagMaxEntries {
+		for k := range c.m {
+			delete(c.m, k)
+			break
+		}
+	}
+	c.m[key] = e
+}
+
+// use keeps a reply carrying an ETag, or answers a 304 Not Modified with the
+// reply kept before.
+func (c *etagCache) use(key string, cached *etagEntry, resp *http.Response) *http.Response {
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		drain(resp)
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        cached.header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       resp.Request,
+		}
+	case resp.StatusCode == http.StatusOK && resp.Request.Method == http.MethodGet &&
+		resp.Header.Get("ETag") != "" && resp.ContentLength <= etagMaxBody:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, etagMaxBody+1))
+		if err != nil || len(body) > etagMaxBody {
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return resp
+		}
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		c.put(key, &etagEntry{etag: resp.Header.Get("ETag"), header: resp.Header.Clone(), body: body})
+	}
+	return resp
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// tokenTransport authenticates the calls to the git API with the tokens of the
+// pool, reading in the current value of each so a refreshed token is used
+// without a new client.  Calls over the rate limit are made again with the
+// next token, and transient failures are retried with a backoff.
+type tokenTransport struct {
+	pool   *tokenPool
+	header string // PRIVATE-TOKEN for GitLab, otherwise a bearer token is sent
+	base   http.RoundTripper
+	etags  etagCache
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	for attempt := 0; ; attempt++ {
+		i, wait := t.pool.pick()
+		if i < 0 {
+			if !idempotent || attempt >= maxRetries || wait > maxRetryWait {
+				return nil, &rateLimitError{host: req.URL.Host, retryAfter: wait}
+			}
+			if err := sleepContext(req.Context(), wait); err != nil {
+				abandoned(req.Context(), "api")
+				return nil, err
+			}
+			continue
+		}
+
+		out := req.Clone(req.Context())
+		if tok := t.pool.tokens[i].Value(); tok != "" {
+			if t.header != "" {
+				out.Header.Set(t.header, tok)
+			} else {
+				out.Header.Set("Authorization", "Bearer "+tok)
+			}
+		}
+		key := strconv.Itoa(i) + " " + req.URL.String()
+		var cached *etagEntry
+		if req.Method == http.MethodGet {
+			if cached = t.etags.get(key); cached != nil {
+				out.Header.Set("If-None-Match", cached.etag)
+			}
+		}
+
+		resp, err := t.base.RoundTrip(out)
+		if err == nil && t.limited(i, resp) {
+			logOf(req.Context(), "upstream").Warn("Rate limited", "host", req.URL.Host, "token", i+1, "tokens", len(t.pool.tokens))
+			drain(resp)
+			if idempotent && attempt < len(t.pool.tokens)+maxRetries {
+				continue
+			}
+			return nil, &rateLimitError{host: req.URL.Host, retryAfter: t.pool.wait(i)}
+		}
+		if !idempotent || attempt >= maxRetries || !transient(req, resp, err) {
+			if err != nil {
+				return nil, err
+			}
+			// The pool rotates the tokens, go-github must not hold back
+			// calls by the rate limit of one of them
+			resp.Header.Del("X-RateLimit-Reset")
+			return t.etags.use(key, cached, resp), nil
+		}
+
+		wait = retryBackoff<<attempt + time.Duration(rand.Int63n(int64(retryBackoff)))
+		if resp != nil {
+			if d := retryAfter(resp.Header); d > maxRetryWait {
+				drain(resp)
+				return nil, &rateLimitError{host: req.URL.Host, retryAfter: d}
+			} else if d > 0 {
+				wait = d
+			}
+			drain(resp)
+		}
+		logOf(req.Context(), "upstream").Info("Retrying call", "host", req.URL.Host, "in", wait.Round(time.Millisecond), "reason", describe(resp, err))
+		if err := sleepContext(req.Context(), wait); err != nil {
+			abandoned(req.Context(), "api")
+			return nil, err
+		}
+	}
+}
+
+// limited records the rate limit reported in the reply, and tells whether the
+// call was refused because of it.
+func (t *tokenTransport) limited(i int, resp *http.Response) bool {
+	remaining := resp.Header.Get("X-RateLimit-Remaining")
+	if remaining == "" {
+		remaining = resp.Header.Get("RateLimit-Remaining")
+	}
+	reset := resetTime(resp.Header)
+	if resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode == http.StatusForbidden &&
+		(remaining == "0" || resp.Header.Get("Retry-After") != "")) {
+		until := reset
+		if d := retryAfter(resp.Header); d > 0 {
+			until = time.Now().Add(d)
+		}
+		if until.IsZero() {
+			until = time.Now().Add(time.Minute)
+		} else if min := time.Now().Add(retryBackoff); until.Before(min) {
+			until = min // a reset in the past is not to be trusted
+		}
+		t.pool.limit(i, until)
+		return true
+	}
+	if remaining == "0" && !reset.IsZero() {
+		t.pool.limit(i, reset)
+	}
+	return false
+}
+
+func transient(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// resetTime returns when the rate limit resets, from the unix time given by
+// GitHub and GitLab.
+func resetTime(h http.Header) time.Time {
+	for _, name := range []string{"X-RateLimit-Reset", "RateLimit-Reset"} {
+		if n, err := strconv.ParseInt(h.Get(name), 10, 64); err == nil {
+			return time.Unix(n, 0)
+		}
+	}
+	return time.Time{}
+}
+
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func describe(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func reply(r *http.Request, status int, header map[string]string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("{}")),
+		Request:    r,
+	}
+	for k, v := range header {
+		resp.Header.Set(k, v)
+	}
+	return resp
+}
+
+func TestTokenTransport(t *testing.T) {
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	tests := []struct {
+		name    string
+		tokens  []string
+		replies func(calls int, token string) (int, map[string]string)
+		calls   int    // how many calls reach the git server
+		status  int    // of the reply, when there is one
+		limited bool   // or the rate limit error
+		token   string // used for the last call
+	}{
+		{
+			name:   "rotates over the limit",
+			tokens: []string{"one", "two"},
+			replies: func(calls int, token string) (int, map[string]string) {
+				if token == "one" {
+					return 403, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": future}
+				}
+				return 200, nil
+			},
+			calls: 2, status: 200, token: "two",
+		},
+		{
+			name:   "every token over the limit",
+			tokens: []string{"one", "two"},
+			replies: func(calls int, token string) (int, map[string]string) {
+				return 429, map[string]string{"X-RateLimit-Reset": future}
+			},
+			calls: 2, limited: true, token: "two",
+		},
+		{
+			// used to be called again at once, for ever
+			name:   "reset in the past",
+			tokens: []string{"one"},
+			replies: func(calls int, token string) (int, map[string]string) {
+				return 429, map[string]string{"X-RateLimit-Reset": past}
+			},
+			calls: 2, limited: true, token: "one",
+		},
+		{
+			name:   "transient failure",
+			tokens: []string{"one"},
+			replies: func(calls int, token string) (int, map[string]string) {
+				if calls == 1 {
+					return 502, nil
+				}
+				return 200, nil
+			},
+			calls: 2, status: 200, token: "one",
+		},
+		{
+			name:   "unavailable for long",
+			tokens: []string{"one"},
+			replies: func(calls int, token string) (int, map[string]string) {
+				return 503, map[string]string{"Retry-After": "120"}
+			},
+			calls: 1, limited: true, token: "one",
+		},
+		{
+			name:   "not found",
+			tokens: []string{"one"},
+			replies: func(calls int, token string) (int, map[string]string) {
+				return 404, nil
+			},
+			calls: 1, status: 404, token: "one",
+		},
+	}
+	for _, tt := range tests {
+		var tokens []*secret
+		for _, tok := range tt.tokens {
+			s, err := newSecret(tok, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, s)
+		}
+		calls, token := 0, ""
+		tr := &tokenTransport{
+			pool:   newTokenPool(tokens),
+			header: "PRIVATE-TOKEN",
+			base: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				calls++
+				token = r.Header.Get("PRIVATE-TOKEN")
+				status, header := tt.replies(calls, token)
+				return reply(r, status, header), nil
+			}),
+		}
+		req := httptest.NewRequest("GET", "https://gitlab.example.com/api/v4/projects/1", nil)
+		resp, err := tr.RoundTrip(req)
+		switch {
+		case tt.limited && !rateLimited(err):
+			t.Errorf("%s: got %v, want a rate limit error", tt.name, err)
+		case !tt.limited && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !tt.limited && resp.StatusCode != tt.status:
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if calls != tt.calls || token != tt.token {
+			t.Errorf("%s: %d calls, the last with %q, want %d with %q", tt.name, calls, token, tt.calls, tt.token)
+		}
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	status := func(code int) *http.Response {
+		return &http.Response{StatusCode: code, Request: httptest.NewRequest("GET", "/", nil)}
+	}
+	tests := []struct {
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{&gitlab.ErrorResponse{Response: status(404)}, 404, ""},
+		{&github.ErrorResponse{Response: status(404)}, 404, ""},
+		{&gitlab.ErrorResponse{Response: status(500)}, 500, ""},
+		{&github.ErrorResponse{Response: status(401)}, 500, ""},
+		{errors.New("connection refused"), 500, ""},
+		{&rateLimitError{host: "gitlab.com", retryAfter: 90 * time.Second}, 503, "90"},
+		{&rateLimitError{host: "gitlab.com"}, 503, "1"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		upstreamError(w, tt.err)
+		if w.Code != tt.status || w.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("upstreamError(%v) = %d, Retry-After %q, want %d, %q",
+				tt.err, w.Code, w.Header().Get("Retry-After"), tt.status, tt.retryAfter)
+		}
+	}
+}
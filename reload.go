@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var watchConfig = flag.Duration("watch", 0, "Check the config file for changes at this interval and reload it (example 10s)")
+
+// The config in use.  A reload builds a new config and swaps it in, requests
+// keep the config they started with.
+var current atomic.Value // *yamlParse
+
+type configKey struct{}
+
+// config returns the config in use.
+func config() *yamlParse {
+	return current.Load().(*yamlParse)
+}
+
+// configOf returns the config the request started with.
+func configOf(r *http.Request) *yamlParse {
+	if c, ok := r.Context().Value(configKey{}).(*yamlParse); ok {
+		return c
+	}
+	return config()
+}
+
+// withConfig pins the config in use to the request.
+func withConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), configKey{}, config())))
+	})
+}
+
+var configLogger = newLogger("config")
+
+var reloadMu sync.Mutex
+
+// reloadConfig reads in the config file again and swaps it in when valid,
+// otherwise the config in use is kept.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c, err := parseConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	old := config()
+	if c.Ledger != old.Ledger || c.ClientAuth != old.ClientAuth || c.ClientCA != old.ClientCA ||
+		c.AuditLog != old.AuditLog || c.AuditLogMaxSize != old.AuditLogMaxSize ||
+		c.AuditLogBackups != old.AuditLogBackups || c.AuditSyslog != old.AuditSyslog ||
+		c.TLS.MinVersion != old.TLS.MinVersion || strings.Join(c.TLS.Ciphers, ",") != strings.Join(old.TLS.Ciphers, ",") {
+		configLogger.Warn("Changes to ledger, client-auth, client-ca, audit and tls version and cipher settings take effect on restart")
+	}
+	if listenerSettings(c) != listenerSettings(old) {
+		configLogger.Warn("Changes to the listeners, besides their access rules and open, take effect on restart")
+	}
+	current.Store(c)
+	if err := loadCertificates(c); err != nil {
+		configLogger.Error("Error loading certificates, keeping the current ones", "err", err)
+	}
+	loadProbes(c)
+	configLogger.Info("Reloaded config", "file", *configFile)
+	return nil
+}
+
+// watchReload reloads the config on SIGHUP, and when -watch is set, when the
+// config file changes.
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var last os.FileInfo
+	if *watchConfig > 0 {
+		tick = time.NewTicker(*watchConfig).C
+		last, _ = os.Stat(*configFile)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-tick:
+				info, err := os.Stat(*configFile)
+				if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+					continue
+				}
+				last = info
+			}
+			if err := reloadConfig(); err != nil {
+				configLogger.Error("Error reloading config, keeping the current one", "err", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := *configFile
+	*configFile = file
+	t.Cleanup(func() { *configFile = saved })
+
+	base := "git-url: https://gitlab.example.com\ngit-provider: offline\n"
+	write(base)
+	c, err := parseConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Store(c)
+
+	// A request in flight keeps the config it started with
+	started, reloaded, done := make(chan *yamlParse), make(chan struct{}), make(chan struct{})
+	var seen *yamlParse
+	handler := withConfig(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- configOf(r)
+		<-reloaded
+		seen = configOf(r)
+	}))
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	first := <-started
+
+	write(base + "modules:\n  x.org/tool: gitlab.example.com/grp/tool\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	close(reloaded)
+	<-done
+	if seen != first {
+		t.Error("the request in flight changed config")
+	}
+	if config() == first {
+		t.Fatal("config not swapped")
+	}
+	if lr, ok := config().Lookup(context.Background(), "x.org/tool"); !ok || lr.groupRepo != "grp/tool" {
+		t.Errorf("module of the new config not found: %+v", lr)
+	}
+
+	// A broken config is rejected, the current one kept
+	reloadedConfig := config()
+	write(base + "ledger-policy: sometimes\n")
+	if err := reloadConfig(); err == nil {
+		t.Error("invalid config loaded")
+	}
+	write("git-url: [\n")
+	if err := reloadConfig(); err == nil {
+		t.Error("config which does not parse loaded")
+	}
+	if config() != reloadedConfig {
+		t.Error("config swapped for an invalid one")
+	}
+}
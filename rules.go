@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The prefix rules are kept in a trie by path element, so finding the rule of
+// a module does not depend on the number of rules.
+type prefixNode struct {
+	children map[string]*prefixNode
+	rules    []int // index in Regexp of the rules for this prefix
+}
+
+// compile checks a rule and compiles its regexp.
+func (elm *yamlMatchReplace) compile(defaultProvider string) (err error) {
+	if (elm.Match == "") == (elm.Prefix == "") {
+		return fmt.Errorf("needs one of match or prefix")
+	}
+	if elm.Prefix != "" {
+		elm.Prefix = strings.Trim(elm.Prefix, "/")
+		if elm.Base != "" || elm.Group != "" || elm.Repo != "" || elm.Path != "" {
+			return fmt.Errorf("prefix rules are mapped with replace")
+		}
+	} else {
+		if elm.regexp, err = regexp.Compile(elm.Match); err != nil {
+			return err
+		}
+		for _, t := range []string{elm.Replace, elm.Base, elm.Group, elm.Repo, elm.Path} {
+			if err = checkTemplate(elm.regexp, t); err != nil {
+				return err
+			}
+		}
+	}
+	if prov := elm.GitLabProvider; (prov == "github" || (elm.GitLabURL == "" && defaultProvider == "github")) &&
+		strings.Contains(elm.Group, "/") {
+		return fmt.Errorf("github has no subgroups, group %q", elm.Group)
+	}
+	return nil
+}
+
+// name is used to tell which rule a module matched.
+func (elm *yamlMatchReplace) name() string {
+	switch {
+	case elm.Name != "":
+		return elm.Name
+	case elm.Prefix != "":
+		return "prefix " + elm.Prefix
+	}
+	return "match " + elm.Match
+}
+
+// loadRules puts the prefix rules in the trie and orders the regexp rules by
+// priority.
+func (data *yamlParse) loadRules() {
+	data.prefixes = &prefixNode{}
+	data.regexpOrder = nil
+	for i := range data.Regexp {
+		elm := &data.Regexp[i]
+		if elm.regexp != nil {
+			data.regexpOrder = append(data.regexpOrder, i)
+			continue
+		}
+		node := data.prefixes
+		for _, part := range strings.Split(elm.Prefix, "/") {
+			next, ok := node.children[part]
+			if !ok {
+				next = &prefixNode{}
+				if node.children == nil {
+					node.children = make(map[string]*prefixNode)
+				}
+				node.children[part] = next
+			}
+			node = next
+		}
+		node.rules = append(node.rules, i)
+	}
+	sort.SliceStable(data.regexpOrder, func(a, b int) bool {
+		return data.Regexp[data.regexpOrder[a]].Priority > data.Regexp[data.regexpOrder[b]].Priority
+	})
+}
+
+// findRule returns the rule for the module and the match in the module path.
+// The prefix rule with the highest priority, and then the longest prefix,
+// is used, unless a regexp rule of higher priority matches.  Rules of the same
+// priority are taken in the order of the config.
+func (data *yamlParse) findRule(pkg string) (*yamlMatchReplace, []int) {
+	best, bestLen := -1, 0
+	node, length := data.prefixes, 0
+	for _, part := range strings.Split(pkg, "/") {
+		if node = node.children[part]; node == nil {
+			break
+		}
+		if length > 0 {
+			length++
+		}
+		length += len(part)
+		for _, i := range node.rules {
+			if best < 0 || data.Regexp[i].Priority > data.Regexp[best].Priority ||
+				(data.Regexp[i].Priority == data.Regexp[best].Priority && length > bestLen) {
+				best, bestLen = i, length
+			}
+		}
+	}
+
+	for _, i := range data.regexpOrder {
+		elm := &data.Regexp[i]
+		if best >= 0 && elm.Priority <= data.Regexp[best].Priority {
+			break
+		}
+		if match := elm.regexp.FindStringSubmatchIndex(pkg); match != nil {
+			return elm, match
+		}
+	}
+	if best < 0 {
+		return nil, nil
+	}
+	return &data.Regexp[best], []int{0, bestLen}
+}
+
+// lookup finds where the module of the request is, naming the rule used in
+// the reply when the lookup subsystem logs at debug level.
+func lookup(w http.ResponseWriter, r *http.Request, module string) (*lookupResult, bool) {
+	lr, ok := configOf(r).Lookup(r.Context(), module)
+	if ok && logOf(r.Context(), "lookup").Enabled(levelDebug) {
+		w.Header().Set("X-Goproxy-Rule", lr.rule)
+	}
+	return lr, ok
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestFindRule(t *testing.T) {
+	data := &yamlParse{Regexp: []yamlMatchReplace{
+		{Name: "platform", Prefix: "company.com/platform"},
+		{Name: "tools", Prefix: "company.com/platform/tools/"},
+		{Name: "company", Prefix: "company.com"},
+		{Name: "special", Match: `company\.com/platform/special.*`},
+		{Name: "github", Match: `github\.com/.*`, Priority: 10},
+		{Name: "owner", Prefix: "github.com/owner"},
+		{Name: "legacy", Prefix: "company.com/legacy", Priority: 20},
+		{Name: "legacy-match", Match: `company\.com/legacy/.*`, Priority: 5},
+		{Name: "other", Match: `other\.org/(.*)`},
+		{Name: "platform-again", Prefix: "company.com/platform"},
+	}}
+	for i := range data.Regexp {
+		if err := data.Regexp[i].compile(""); err != nil {
+			t.Fatalf("rule %d: %v", i, err)
+		}
+	}
+	data.loadRules()
+
+	tests := []struct {
+		module string
+		rule   string // empty when none matches
+		end    int    // end of the match in the module path
+	}{
+		{"company.com/platform/x", "platform", len("company.com/platform")},
+		{"company.com/platform", "platform", len("company.com/platform")},
+		{"company.com/platform/tools/cli", "tools", len("company.com/platform/tools")},
+		{"company.com/platformx/y", "company", len("company.com")}, // whole path elements only
+		{"company.com", "company", len("company.com")},
+		{"company.com/platform/special", "platform", len("company.com/platform")},
+		{"github.com/owner/repo", "github", len("github.com/owner/repo")},
+		{"company.com/legacy/x", "legacy", len("company.com/legacy")},
+		{"company.com/legacyx", "company", len("company.com")},
+		{"other.org/x/y", "other", len("other.org/x/y")},
+		{"unknown.net/x", "", 0},
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		elm, match := data.findRule(tt.module)
+		switch {
+		case tt.rule == "":
+			if elm != nil {
+				t.Errorf("findRule(%q) = %s, want none", tt.module, elm.name())
+			}
+		case elm == nil:
+			t.Errorf("findRule(%q) = none, want %s", tt.module, tt.rule)
+		case elm.name() != tt.rule:
+			t.Errorf("findRule(%q) = %s, want %s", tt.module, elm.name(), tt.rule)
+		case match[1] != tt.end:
+			t.Errorf("findRule(%q) matched up to %d, want %d", tt.module, match[1], tt.end)
+		}
+	}
+}
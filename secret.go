@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// How often secrets from files and credential helpers are read again, so
+// rotated secrets are picked up, and how long a credential helper may take.
+const (
+	secretRefresh = 5 * time.Minute
+	helperTimeout = 30 * time.Second
+)
+
+// A secret from the config.  The value in the config may be the secret
+// itself, contain ${ENV} variables, or be file:/path/to/secret.  Or the secret
+// is asked for from a git credential helper.
+type secret struct {
+	source string // as written in the config
+	helper string // git credential helper command
+	url    string // git server given to the credential helper
+
+	mu         sync.Mutex
+	value      string
+	fetched    time.Time
+	expiry     time.Time
+	refreshing bool
+}
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func (s *secret) UnmarshalYAML(value *yaml.Node) error {
+	return value.Decode(&s.source)
+}
+
+// loadSecret reads in a secret of the config, or the one from the credential
+// helper, failing when it cannot be found.
+func loadSecret(s *secret, helper, serverURL string) (*secret, error) {
+	if s == nil && helper == "" {
+		return nil, nil
+	}
+	source := ""
+	if s != nil {
+		source = s.source
+	}
+	return newSecret(source, helper, serverURL)
+}
+
+// loadSecrets reads in a list of secrets of the config in place.
+func loadSecrets(list []*secret, serverURL string) (err error) {
+	for i, s := range list {
+		if s == nil {
+			return fmt.Errorf("empty token %d", i+1)
+		}
+		if list[i], err = newSecret(s.source, "", serverURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newSecret(source, helper, serverURL string) (*secret, error) {
+	if source != "" && helper != "" {
+		return nil, errors.New("both a token and a git-credential-helper are given")
+	}
+	s := &secret{source: source, helper: helper, url: serverURL}
+	value, expiry, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.value, s.expiry, s.fetched = value, expiry, time.Now()
+	registerSecret(value)
+	return s, nil
+}
+
+// plainSecret wraps a secret which does not need to be read in, such as the
+// credentials sent by a client.
+func plainSecret(value string) *secret {
+	return &secret{value: value}
+}
+
+// Value returns the secret, starting to read it in again in the background
+// when due.  Until that is done, or when it fails, the value read before is
+// used.
+func (s *secret) Value() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refreshes() && !s.refreshing {
+		now := time.Now()
+		if now.Sub(s.fetched) > secretRefresh || (!s.expiry.IsZero() && now.After(s.expiry)) {
+			s.fetched, s.refreshing = now, true
+			go s.refresh()
+		}
+	}
+	return s.value
+}
+
+func (s *secret) refresh() {
+	value, expiry, err := s.read()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshing = false
+	if err != nil {
+		newLogger("secrets").Error("Error refreshing secret", "secret", s, "err", err)
+		return
+	}
+	s.value, s.expiry = value, expiry
+	registerSecret(value)
+}
+
+func (s *secret) refreshes() bool {
+	return s.helper != "" || strings.HasPrefix(s.source, "file:")
+}
+
+func (s *secret) read() (value string, expiry time.Time, err error) {
+	switch {
+	case s.helper != "":
+		return credentialHelper(s.helper, s.url)
+	case strings.HasPrefix(s.source, "file:"):
+		var raw []byte
+		raw, err = os.ReadFile(strings.TrimPrefix(s.source, "file:"))
+		value = strings.TrimSpace(string(raw))
+		if err == nil && value == "" {
+			err = fmt.Errorf("%s is empty", s.source)
+		}
+		return
+	}
+	value = envRef.ReplaceAllStringFunc(s.source, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+	return
+}
+
+// String describes where the secret comes from, without the secret itself.
+func (s *secret) String() string {
+	switch {
+	case s == nil || (s.source == "" && s.helper == ""):
+		return ""
+	case s.helper != "":
+		return "credential-helper:" + s.helper
+	case strings.HasPrefix(s.source, "file:"):
+		return s.source
+	case envRef.ReplaceAllString(s.source, "") == "":
+		return s.source
+	}
+	return "<redacted>"
+}
+
+// MarshalJSON keeps the secret out of the config printed with -verbose.
+func (s *secret) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(s.String())), nil
+}
+
+// credentialHelper asks a git credential helper for the password of the git
+// server, as git does with "credential.helper".
+func credentialHelper(helper, serverURL string) (password string, expiry time.Time, err error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return
+	}
+	// As git: !command is a shell command, a path is run as is, and a name
+	// is run as git credential-name
+	command := helper
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		command = helper[1:]
+	case filepath.IsAbs(helper):
+	default:
+		command = "git credential-" + helper
+	}
+	ctx, cancel := context.WithTimeout(baseCtx, helperTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command+" get")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=%s\nhost=%s\n\n", u.Scheme, u.Host))
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = io.Discard // may contain secrets
+	if err = cmd.Run(); err != nil {
+		return "", expiry, fmt.Errorf("credential helper %s: %w", helper, err)
+	}
+
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "password":
+			password = value
+		case "password_expiry_utc":
+			if t, err := strconv.ParseInt(value, 10, 64); err == nil {
+				expiry = time.Unix(t, 0)
+			}
+		}
+	}
+	if password == "" {
+		err = fmt.Errorf("credential helper %s gave no password for %s", helper, u.Host)
+	}
+	return
+}
+
+// The secrets which have been read in, so they can be removed from what is
+// logged.
+var secrets struct {
+	sync.Mutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+func registerSecret(value string) {
+	if len(value) < 4 {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	if secrets.values[value] {
+		return
+	}
+	if secrets.values == nil {
+		secrets.values = make(map[string]bool)
+	}
+	secrets.values[value] = true
+	var pairs []string
+	for v := range secrets.values {
+		pairs = append(pairs, v, "<redacted>")
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// redactWriter removes the secrets from the log output.
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	secrets.Lock()
+	replacer := secrets.replacer
+	secrets.Unlock()
+	if replacer == nil {
+		return r.w.Write(p)
+	}
+	if _, err := io.WriteString(r.w, replacer.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecretSources(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GOPROXY_TEST_TOKEN", "env-secret-1")
+	tokenFile := filepath.Join(dir, "token")
+	os.WriteFile(tokenFile, []byte("file-secret-1\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "empty"), nil, 0600)
+	helper := filepath.Join(dir, "helper")
+	os.WriteFile(helper, []byte("#!/bin/sh\ngrep -q '^host=git.example.com$' && echo password=helper-secret-1 && echo password_expiry_utc=4102444800\n"), 0700)
+
+	tests := []struct {
+		source, helper string
+		value, shown   string // shown in logs and with -verbose
+		fails          bool
+	}{
+		{source: "plain-secret-1", value: "plain-secret-1", shown: "<redacted>"},
+		{source: "${GOPROXY_TEST_TOKEN}", value: "env-secret-1", shown: "${GOPROXY_TEST_TOKEN}"},
+		{source: "Bearer ${GOPROXY_TEST_TOKEN}", value: "Bearer env-secret-1", shown: "<redacted>"},
+		{source: "${GOPROXY_TEST_UNSET}", fails: true},
+		{source: "file:" + tokenFile, value: "file-secret-1", shown: "file:" + tokenFile},
+		{source: "file:" + filepath.Join(dir, "empty"), fails: true},
+		{source: "file:" + filepath.Join(dir, "missing"), fails: true},
+		{helper: helper, value: "helper-secret-1", shown: "credential-helper:" + helper},
+		{source: "plain-secret-1", helper: helper, fails: true},
+	}
+	for _, tt := range tests {
+		s, err := newSecret(tt.source, tt.helper, "https://git.example.com/api")
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s%s: read in without error", tt.source, tt.helper)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s%s: %v", tt.source, tt.helper, err)
+			continue
+		}
+		if s.Value() != tt.value || s.String() != tt.shown {
+			t.Errorf("%s%s: value %q shown as %q, want %q shown as %q", tt.source, tt.helper, s.Value(), s, tt.value, tt.shown)
+		}
+		if out, _ := json.Marshal(struct{ Token *secret }{s}); strings.Contains(string(out), tt.value) {
+			t.Errorf("%s%s: secret in the JSON %s", tt.source, tt.helper, out)
+		}
+		if tt.helper != "" && !s.expiry.Equal(time.Unix(4102444800, 0)) {
+			t.Errorf("%s: expiry %v", tt.helper, s.expiry)
+		}
+	}
+
+	// What is logged has the secrets read in removed
+	var buf bytes.Buffer
+	redactWriter{&buf}.Write([]byte("token=plain-secret-1 file=file-secret-1 env=env-secret-1\n"))
+	if buf.String() != "token=<redacted> file=<redacted> env=<redacted>\n" {
+		t.Errorf("logged %q", buf.String())
+	}
+}
+
+func TestSecretRefresh(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(file, []byte("rotated-secret-1"), 0600)
+	s, err := newSecret("file:"+file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(file, []byte("rotated-secret-2"), 0600)
+	if s.Value() != "rotated-secret-1" {
+		t.Fatal("secret read in again before it is due")
+	}
+
+	// Once due, the value read before is used until the new one is in
+	s.mu.Lock()
+	s.fetched = time.Now().Add(-secretRefresh - time.Second)
+	s.mu.Unlock()
+	if v := s.Value(); v != "rotated-secret-1" && v != "rotated-secret-2" {
+		t.Fatalf("secret %q while refreshing", v)
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.Value() != "rotated-secret-2"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated secret not read in")
+		}
+	}
+
+	// A failed refresh keeps the secret
+	os.Remove(file)
+	s.mu.Lock()
+	s.fetched = time.Now().Add(-secretRefresh - time.Second)
+	s.mu.Unlock()
+	s.Value()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		refreshing := s.refreshing
+		s.mu.Unlock()
+		if !refreshing || time.Now().After(deadline) {
+			break
+		}
+	}
+	if s.Value() != "rotated-secret-2" {
+		t.Error("secret lost on a failed refresh")
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The selftest serves generated repositories with fake git servers, then has
+// the go command fetch the modules through the proxy and in direct mode from
+// the same repositories.  Both must give the same versions and h1: hashes.
+
+// A repository of the selftest, built commit by commit.
+type selftestRepo struct {
+	path    string // host/path, ie: gitlab.selftest/grp/repo
+	commits []selftestCommit
+}
+
+type selftestCommit struct {
+	files map[string]string // contents by file name, "" removes the file
+	links map[string]string // submodules by path, to the head of another repository
+	tags  []string
+}
+
+// When the first commit of the selftest is made, the next ones follow by the
+// hour so the pseudo-versions are the same on every run.
+var selftestEpoch = time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func selftestRepos() []selftestRepo {
+	gomod := func(module string) string { return "module " + module + "\n\ngo 1.18\n" }
+	gl, gh := fakeGitLabHost+"/", fakeGitHubHost+"/"
+	return []selftestRepo{
+		{path: gl + "grp/untagged", commits: []selftestCommit{
+			{files: map[string]string{"go.mod": gomod(gl + "grp/untagged"), "untagged.go": "package untagged\n"}},
+			{files: map[string]string{"untagged.go": "package untagged\n\nconst Answer = 42\n"}},
+		}},
+		// Tags, a pseudo-version after the last one, vendor directories, a
+		// nested module with its own tags and a submodule
+		{path: gl + "grp/repo", commits: []selftestCommit{
+			{files: map[string]string{
+				"go.mod":                        gomod(gl + "grp/repo"),
+				"LICENSE":                       "Selftest license\n",
+				"repo.go":                       "package repo\n",
+				"pkg/pkg.go":                    "package pkg\n",
+				"testdata/input.txt":            "kept in the module zip\n",
+				"vendor/modules.txt":            "# example.com/dep v1.0.0\n## explicit\nexample.com/dep\n",
+				"vendor/example.com/dep/dep.go": "package dep\n",
+				"internal/vendor/vendored.go":   "package vendor\n",
+				"sub/go.mod":                    gomod(gl + "grp/repo/sub"),
+				"sub/sub.go":                    "package sub\n",
+				".gitmodules":                   "[submodule \"third_party/ext\"]\n\tpath = third_party/ext\n\turl = http://" + gl + "grp/untagged\n",
+			}, links: map[string]string{"third_party/ext": gl + "grp/untagged"}, tags: []string{"v1.0.0", "sub/v1.0.0"}},
+			{files: map[string]string{"repo.go": "package repo\n\nconst Version = \"v1.1.0\"\n"}, tags: []string{"v1.1.0"}},
+			{files: map[string]string{"repo.go": "package repo\n\nconst Version = \"unreleased\"\n"}},
+		}},
+		// Major version on a branch
+		{path: gl + "grp/major", commits: []selftestCommit{
+			{files: map[string]string{"go.mod": gomod(gl + "grp/major"), "major.go": "package major\n"}, tags: []string{"v1.0.0"}},
+			{files: map[string]string{"go.mod": gomod(gl + "grp/major/v2"), "major.go": "package major\n\nconst V = 2\n"}, tags: []string{"v2.0.0"}},
+			{files: map[string]string{"major.go": "package major\n\nconst V = 2.1\n"}, tags: []string{"v2.1.0"}},
+		}},
+		// Major version in a subdirectory
+		{path: gl + "grp/subdir", commits: []selftestCommit{
+			{files: map[string]string{
+				"go.mod":       gomod(gl + "grp/subdir"),
+				"subdir.go":    "package subdir\n",
+				"v2/go.mod":    gomod(gl + "grp/subdir/v2"),
+				"v2/subdir.go": "package subdir\n\nconst V = 2\n",
+			}, tags: []string{"v1.0.0", "v2.0.0"}},
+		}},
+		// Upper case letters in the module path and versions
+		{path: gl + "grp/CamelCase", commits: []selftestCommit{
+			{files: map[string]string{"go.mod": gomod(gl + "grp/CamelCase"), "Camel.go": "package camel\n"}, tags: []string{"v1.0.0-RC1"}},
+			{files: map[string]string{"Camel.go": "package camel\n\nconst Final = true\n"}, tags: []string{"v1.0.0"}},
+		}},
+		{path: gh + "owner/tool", commits: []selftestCommit{
+			{files: map[string]string{
+				"go.mod":                        gomod(gh + "owner/tool"),
+				"tool.go":                       "package tool\n",
+				"cmd/tool/main.go":              "package main\n\nfunc main() {}\n",
+				"vendor/modules.txt":            "# example.com/dep v1.0.0\n## explicit\nexample.com/dep\n",
+				"vendor/example.com/dep/dep.go": "package dep\n",
+			}, tags: []string{"v1.0.0"}},
+			{files: map[string]string{"tool.go": "package tool\n\nconst Version = \"v1.2.0\"\n"}, tags: []string{"v1.2.0"}},
+			{files: map[string]string{"tool.go": "package tool\n\nconst Version = \"unreleased\"\n"}},
+		}},
+		{path: gh + "owner/Mixed", commits: []selftestCommit{
+			{files: map[string]string{"go.mod": gomod(gh + "owner/Mixed"), "mixed.go": "package mixed\n"}, tags: []string{"v0.1.0"}},
+		}},
+		// Requires modules of both servers, for go get
+		{path: gl + "grp/app", commits: []selftestCommit{
+			{files: map[string]string{
+				"go.mod": "module " + gl + "grp/app\n\ngo 1.18\n\nrequire (\n\t" + gh + "owner/tool v1.0.0\n\t" + gl + "grp/repo v1.0.0\n)\n",
+				"app.go": "package app\n",
+			}, tags: []string{"v1.0.0"}},
+		}},
+	}
+}
+
+// A check runs the go command the same way in direct mode and through the
+// proxy, and compares the outcome.
+type selftestCheck struct {
+	kind string // download, list or get
+	args []string
+}
+
+func (c selftestCheck) String() string {
+	return c.kind + " " + strings.Join(c.args, " ")
+}
+
+func selftestChecks(heads map[string][]string) []selftestCheck {
+	gl, gh := fakeGitLabHost+"/", fakeGitHubHost+"/"
+	download := func(args ...string) (checks []selftestCheck) {
+		for _, a := range args {
+			checks = append(checks, selftestCheck{kind: "download", args: []string{a}})
+		}
+		return
+	}
+	checks := download(
+		gl+"grp/repo@v1.0.0",
+		gl+"grp/repo@v1.1.0",
+		gl+"grp/repo@latest",
+		gl+"grp/repo@main",
+		gl+"grp/repo@"+heads[gl+"grp/repo"][2][:12],
+		gl+"grp/repo/sub@v1.0.0",
+		gl+"grp/untagged@latest",
+		gl+"grp/major@v1.0.0",
+		gl+"grp/major/v2@v2.0.0",
+		gl+"grp/major/v2@latest",
+		gl+"grp/subdir@v1.0.0",
+		gl+"grp/subdir/v2@v2.0.0",
+		gl+"grp/CamelCase@v1.0.0-RC1",
+		gl+"grp/CamelCase@latest",
+		gh+"owner/tool@v1.0.0",
+		gh+"owner/tool@latest",
+		gh+"owner/tool@main",
+		gh+"owner/Mixed@v0.1.0",
+	)
+	for _, module := range []string{gl + "grp/repo", gl + "grp/repo/sub", gl + "grp/untagged", gl + "grp/major/v2",
+		gl + "grp/subdir", gl + "grp/CamelCase", gh + "owner/tool", gh + "owner/Mixed"} {
+		checks = append(checks, selftestCheck{kind: "list", args: []string{module}})
+	}
+	checks = append(checks,
+		selftestCheck{kind: "get", args: []string{gl + "grp/app@v1.0.0", gh + "owner/tool@latest"}},
+		selftestCheck{kind: "get", args: []string{gl + "grp/CamelCase@v1.0.0", gh + "owner/Mixed@latest"}},
+	)
+	return checks
+}
+
+// selftestCommand implements the selftest command.  It returns the exit code,
+// 1 when the proxy and direct mode differ.
+func selftestCommand(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	goCmd := fs.String("go", "go", "The go command to fetch the modules with")
+	gitCmd := fs.String("git", "git", "The git command to build and serve the repositories with")
+	keep := fs.Bool("keep", false, "Keep the repositories, module caches and proxy logs")
+	fs.Parse(args)
+
+	for _, cmd := range []*string{goCmd, gitCmd} {
+		p, err := exec.LookPath(*cmd)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		*cmd = p
+	}
+	dir, err := os.MkdirTemp("", "goproxy-selftest")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *keep {
+		fmt.Println("selftest files in", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	// Interrupted, the proxies are stopped and the files removed
+	ctx, cancel := signal.NotifyContext(baseCtx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	f := &fakeGit{root: filepath.Join(dir, "git"), git: *gitCmd}
+	heads, err := f.build(ctx, selftestRepos())
+	if err != nil {
+		fmt.Println("building the repositories:", err)
+		return 1
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	f.addr = ln.Addr().String()
+	server := &http.Server{Handler: f}
+	go server.Serve(ln)
+	defer server.Close()
+
+	direct := &selftestMode{name: "direct", dir: filepath.Join(dir, "direct"), goCmd: *goCmd, env: []string{
+		"GOPROXY=direct", "GOINSECURE=" + fakeGitLabHost + "," + fakeGitHubHost,
+		"http_proxy=http://" + f.addr, "https_proxy=http://" + f.addr,
+		"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=" + os.DevNull}}
+	modes := []*selftestMode{direct}
+	// The proxy is tested building the module zips in the cache, and
+	// streaming them without one
+	for _, cached := range []bool{true, false} {
+		m := &selftestMode{name: "proxy", goCmd: *goCmd}
+		if !cached {
+			m.name = "proxy without cache"
+		}
+		m.dir = filepath.Join(dir, strings.ReplaceAll(m.name, " ", "-"))
+		addr, stop, err := startSelftestProxy(ctx, m.dir, f.addr, cached)
+		if err != nil {
+			fmt.Printf("starting the %s: %v\n", m.name, err)
+			return 1
+		}
+		defer stop()
+		m.env = []string{"GOPROXY=http://" + addr}
+		modes = append(modes, m)
+	}
+
+	// Each check is counted once per proxy mode
+	checks := selftestChecks(heads)
+	total, failed := len(checks)*(len(modes)-1), 0
+	for _, c := range checks {
+		if ctx.Err() != nil {
+			fmt.Println("interrupted")
+			return 1
+		}
+		// Every check works in direct mode, otherwise the test itself is
+		// broken and there is nothing to compare with
+		want := direct.check(ctx, c)
+		if strings.HasPrefix(want, "error: ") {
+			failed += len(modes) - 1
+			fmt.Printf("FAIL  %s (direct)\n", c)
+			fmt.Printf("      %s\n", indent(want, "      "))
+			continue
+		}
+		for _, m := range modes[1:] {
+			got := m.check(ctx, c)
+			if got == want {
+				fmt.Printf("ok    %s (%s)\n", c, m.name)
+				continue
+			}
+			failed++
+			fmt.Printf("FAIL  %s (%s)\n", c, m.name)
+			fmt.Printf("      direct: %s\n", indent(want, "              "))
+			fmt.Printf("      %s: %s\n", m.name, indent(got, strings.Repeat(" ", len(m.name)+8)))
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed", failed, total)
+		if !*keep {
+			fmt.Print(", run with -keep for the proxy logs")
+		}
+		fmt.Println()
+		return 1
+	}
+	fmt.Printf("all %d checks passed\n", total)
+	return 0
+}
+
+// build creates the repositories and returns the commits of each.
+func (f *fakeGit) build(ctx context.Context, repos []selftestRepo) (map[string][]string, error) {
+	heads := make(map[string][]string)
+	when := selftestEpoch
+	for _, repo := range repos {
+		dir := filepath.Join(f.root, filepath.FromSlash(repo.path))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		git := func(args ...string) (string, error) {
+			cmd := f.command(ctx, repo.path, args...)
+			date := when.Format(time.RFC3339)
+			cmd.Env = append(cmd.Env, "GIT_AUTHOR_NAME=selftest", "GIT_AUTHOR_EMAIL=selftest@"+fakeGitLabHost,
+				"GIT_COMMITTER_NAME=selftest", "GIT_COMMITTER_EMAIL=selftest@"+fakeGitLabHost,
+				"GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				return "", fmt.Errorf("%s: git %s: %v: %s", repo.path, strings.Join(args, " "), err, out)
+			}
+			return strings.TrimSpace(string(out)), nil
+		}
+		if _, err := git("init", "-q", "-b", "main"); err != nil {
+			return nil, err
+		}
+		for _, c := range repo.commits {
+			for name, content := range c.files {
+				file := filepath.Join(dir, filepath.FromSlash(name))
+				if content == "" {
+					os.Remove(file)
+					continue
+				}
+				os.MkdirAll(filepath.Dir(file), 0755)
+				if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := git("add", "-A"); err != nil {
+				return nil, err
+			}
+			for name, target := range c.links {
+				linked := heads[target]
+				if len(linked) == 0 {
+					return nil, fmt.Errorf("%s: submodule %s of unknown repository %s", repo.path, name, target)
+				}
+				// An empty directory, as a submodule not checked out
+				os.MkdirAll(filepath.Join(dir, filepath.FromSlash(name)), 0755)
+				if _, err := git("update-index", "--add", "--cacheinfo", "160000,"+linked[len(linked)-1]+","+name); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := git("commit", "-q", "-m", "selftest commit"); err != nil {
+				return nil, err
+			}
+			for _, tag := range c.tags {
+				if _, err := git("tag", "-a", "-m", tag, tag); err != nil {
+					return nil, err
+				}
+			}
+			sha, err := git("rev-parse", "HEAD")
+			if err != nil {
+				return nil, err
+			}
+			heads[repo.path] = append(heads[repo.path], sha)
+			when = when.Add(time.Hour)
+		}
+	}
+	return heads, nil
+}
+
+// startSelftestProxy runs this proxy against the fake git servers, with its
+// config and log in dir.
+func startSelftestProxy(ctx context.Context, dir, gitAddr string, cached bool) (addr string, stop func(), err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	conf := fmt.Sprintf(`git-url: http://%[1]s
+git-provider: gitlab
+git-token: selftest
+transport:
+  proxy: none
+regexp:
+  - prefix: %[2]s
+    git-url: http://%[1]s
+    git-provider: github
+    git-token: selftest
+`, gitAddr, fakeGitHubHost)
+	if cached {
+		conf += "local-cache: " + filepath.Join(dir, "cache") + "\n"
+	}
+	if err = os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(conf), 0644); err != nil {
+		return
+	}
+	logFile, err := os.Create(filepath.Join(dir, "proxy.log"))
+	if err != nil {
+		return
+	}
+	defer logFile.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	addr = ln.Addr().String()
+	ln.Close()
+	self, err := os.Executable()
+	if err != nil {
+		return
+	}
+	args := []string{"-CA", *caFile, "-config", filepath.Join(dir, "config.yaml"), "-listen", addr,
+		"-log-level", *logLevel, "-log-levels", *logLevels, "-log-format", *logFormat}
+	if *verbose {
+		args = append(args, "-verbose")
+	}
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	stop = func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+		}
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		select {
+		case <-exited:
+			return "", nil, errors.New("the proxy exited, see " + logFile.Name())
+		default:
+		}
+		if resp, err := http.Get("http://" + addr + "/healthz"); err == nil {
+			resp.Body.Close()
+			return addr, stop, nil
+		}
+	}
+	stop()
+	return "", nil, errors.New("the proxy did not start, see " + logFile.Name())
+}
+
+// A way of fetching modules: direct or through a proxy, with a module cache of
+// its own.
+type selftestMode struct {
+	name, dir, goCmd string
+	env              []string
+	gets             int
+}
+
+// check runs the go command for a check, and sums up the outcome.
+func (m *selftestMode) check(ctx context.Context, c selftestCheck) string {
+	switch c.kind {
+	case "download":
+		out, err := m.goCommand(ctx, "", append([]string{"mod", "download", "-json"}, c.args...)...)
+		var reply struct{ Version, Sum, GoModSum, Error string }
+		if json.Unmarshal(out, &reply) != nil {
+			return "error: " + err.Error()
+		}
+		if reply.Error != "" {
+			return "error: " + reply.Error
+		}
+		return fmt.Sprintf("%s %s go.mod %s", reply.Version, reply.Sum, reply.GoModSum)
+	case "list":
+		out, err := m.goCommand(ctx, "", append([]string{"list", "-m", "-versions", "-json"}, c.args...)...)
+		var reply struct {
+			Versions []string
+			Error    *struct{ Err string }
+		}
+		if json.Unmarshal(out, &reply) != nil {
+			return "error: " + err.Error()
+		}
+		if reply.Error != nil {
+			return "error: " + reply.Error.Err
+		}
+		return "versions [" + strings.Join(reply.Versions, " ") + "]"
+	case "get":
+		m.gets++
+		dir := filepath.Join(m.dir, fmt.Sprintf("get%d", m.gets))
+		os.MkdirAll(dir, 0755)
+		if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module selftest.local/app\n\ngo 1.18\n"), 0644); err != nil {
+			return "error: " + err.Error()
+		}
+		if _, err := m.goCommand(ctx, dir, append([]string{"get"}, c.args...)...); err != nil {
+			return "error: " + err.Error()
+		}
+		mod, _ := os.ReadFile(filepath.Join(dir, "go.mod"))
+		sum, _ := os.ReadFile(filepath.Join(dir, "go.sum"))
+		return strings.TrimSpace(string(mod)) + "\n" + strings.TrimSpace(string(sum))
+	}
+	return "error: unknown check " + c.kind
+}
+
+// goCommand runs the go command in dir, by default an empty directory outside
+// of any module, with the environment of the mode.  It returns the output, and
+// an error with the last line of the error output when it fails.
+func (m *selftestMode) goCommand(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	if dir == "" {
+		dir = filepath.Join(m.dir, "empty")
+		os.MkdirAll(dir, 0755)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, m.goCmd, args...)
+	cmd.Dir = dir
+	cmd.Env = append(selftestEnviron(),
+		"GOPATH="+filepath.Join(m.dir, "gopath"), "GOMODCACHE="+filepath.Join(m.dir, "modcache"),
+		"GOCACHE="+filepath.Join(m.dir, "gocache"), "GOFLAGS=-modcacherw", "GOSUMDB=off",
+		"GOTOOLCHAIN=local", "GO111MODULE=on", "GOWORK=off", "GOENV=off")
+	cmd.Env = append(cmd.Env, m.env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if last := lines[len(lines)-1]; last != "" {
+			err = errors.New(last)
+		}
+	}
+	return out, err
+}
+
+// selftestEnviron is the environment without the settings of the go command,
+// git and proxies, which would change what is fetched from where.
+func selftestEnviron() (env []string) {
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		upper := strings.ToUpper(name)
+		if (strings.HasPrefix(name, "GO") && name != "GOROOT") || strings.HasPrefix(name, "GIT_") ||
+			strings.HasSuffix(upper, "_PROXY") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return
+}
+
+func indent(s, prefix string) string {
+	return strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
@@ -7,81 +7,151 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/google/go-github/v50/github"
 	"github.com/xanzy/go-gitlab"
 	"gopkg.in/yaml.v3"
 )
 
+var configFile = flag.String("config", "config.yaml", "Config file for matching and connecting gitlab runners")
+
+// The context all the work derives from, canceled on shutdown.
+var baseCtx, cancelUpstream = context.WithCancel(context.Background())
+
+// Deadlines of the work done for a request.
 var (
-	data       yamlParse
-	configFile = flag.String("config", "config.yaml", "Config file for matching and connecting gitlab runners")
-	ctx        = context.Background()
+	apiTimeout   = flag.Duration("api-timeout", 30*time.Second, "Longest time for the git API calls made for one request")
+	fetchTimeout = flag.Duration("fetch-timeout", 10*time.Minute, "Longest time to download an archive from a git server and build its module zip")
 )
 
 type yamlParse struct {
 	Modules map[string]string  `yaml:"modules"`
 	Regexp  []yamlMatchReplace `yaml:"regexp"`
 
-	GitLabToken    string `yaml:"git-token"`
-	GitLabURL      string `yaml:"git-url"`
-	GitLabProvider string `yaml:"git-provider"`
+	GitLabToken    *secret   `yaml:"git-token"`  // the token, ${ENV} or file:/path
+	GitTokens      []*secret `yaml:"git-tokens"` // more tokens, used in turn
+	GitLabURL      string    `yaml:"git-url"`
+	GitLabProvider string    `yaml:"git-provider"`
+	GitAuth        string    `yaml:"git-auth"` // token (default) or passthrough
+	GitHelper      string    `yaml:"git-credential-helper"`
+	// Number of groups the project is in, or probe to ask GitLab, for at most
+	// max-group-depth groups
+	GroupDepth    string `yaml:"group-depth"`
+	MaxGroupDepth int    `yaml:"max-group-depth"`
+	// CAs, client certificate, proxy and limits of the connections
+	Transport *yamlTransport `yaml:"transport"`
 	//GitLabBase     string `yaml:"git-base"`
 	// Defines a Gitlab client
 	gitClient interface{} //*gitlab.Client
+	backend   *backend
 
 	LocalCache string `yaml:"local-cache"`
+
+	// Append-only record of the content served for each module@version
+	Ledger       string `yaml:"ledger"`
+	LedgerPolicy string `yaml:"ledger-policy"` // refuse (default) or alert
+
+	// Minimum version, ciphers and certificates of the server
+	TLS yamlTLS `yaml:"tls"`
+
+	// Client certificate verification and the access rules for clients
+	ClientAuth string       `yaml:"client-auth"` // none (default), request or require
+	ClientCA   string       `yaml:"client-ca"`   // PEM file of the CAs of client certificates
+	Access     []yamlAccess `yaml:"access"`
+
+	// Where to listen, instead of -listen and -tls
+	Listeners []yamlListener `yaml:"listeners"`
+
+	// Trusted issuers of OIDC bearer tokens, which claims can be used in the
+	// access rules
+	OIDC []yamlOIDC `yaml:"oidc"`
+
+	// JSON lines audit log of every request, rotated by size in MB, and/or
+	// sent to syslog (local or ie: udp://loghost:514)
+	AuditLog        string `yaml:"audit-log"`
+	AuditLogMaxSize int    `yaml:"audit-log-max-size"`
+	AuditLogBackups int    `yaml:"audit-log-backups"`
+	AuditSyslog     string `yaml:"audit-syslog"`
+
+	// Expected mappings of modules, checked when the config is loaded
+	Tests []yamlTest `yaml:"tests"`
+
+	prefixes    *prefixNode
+	regexpOrder []int
 }
+
+// A rule maps the modules matching the regexp, or under the prefix, to a git
+// server and repository.  Replace rewrites the matched part of the module
+// path, which is then split into host/group/repo/path.  The base (host), group
+// (namespace, which may hold subgroups), repo and path (folder in the repo)
+// templates set the parts from the match directly, ie: "$1" or "${name}", and
+// win over replace.
 type yamlMatchReplace struct {
-	Match  string `yaml:"match"`
-	Base   string `yaml:"base"`
-	Group  string `yaml:"group"`
-	Repo   string `yaml:"repo"`
-	regexp *regexp.Regexp
-
-	GitLabToken    string `yaml:"git-token"`
-	GitLabURL      string `yaml:"git-url"`
-	GitLabProvider string `yaml:"git-provider"`
+	Name     string `yaml:"name"`
+	Match    string `yaml:"match"`
+	Prefix   string `yaml:"prefix"` // ie: company.com/platform, matched by path element
+	Priority int    `yaml:"priority"`
+	Replace  string `yaml:"replace"`
+	Base     string `yaml:"base"`
+	Group    string `yaml:"group"`
+	Repo     string `yaml:"repo"`
+	Path     string `yaml:"path"`
+	regexp   *regexp.Regexp
+
+	GitLabToken    *secret   `yaml:"git-token"`
+	GitTokens      []*secret `yaml:"git-tokens"`
+	GitLabURL      string    `yaml:"git-url"`
+	GitLabProvider string    `yaml:"git-provider"`
+	GitAuth        string    `yaml:"git-auth"`
+	GitHelper      string    `yaml:"git-credential-helper"`
+	GroupDepth     string    `yaml:"group-depth"`
+	// Settings of the connections, the default ones when not set
+	Transport *yamlTransport `yaml:"transport"`
 	//GitLabBase     string `yaml:"git-base"`
 	// Defines a Gitlab client
 	gitClient interface{}
+	backend   *backend
 }
 
 type cacheEntry struct {
 	dir, path, ver, date, sha string
 }
 
-func checkCache(module, version string) *cacheEntry {
-	//fmt.Println("checking cache", module, version)
-	entries, err := os.ReadDir(path.Join(data.LocalCache, module))
+func checkCache(dir, module, version string) *cacheEntry {
+	module, version = cacheName(module), cacheName(version)
+	entries, err := os.ReadDir(path.Join(dir, module))
 	if err != nil {
 		return nil
 	}
 	var f cacheEntry
 	for _, e := range entries {
 		name := e.Name()
-		//fmt.Println(e.Name())
 		if !strings.HasSuffix(name, ".tgz") || len(name) < 59 {
 			continue
 		}
+		// names are <version><date:14>-<sha:40>.tgz, the version may be empty
 		dp := len(name) - 59
 		f.ver = name[:dp]           // get version (if any)
 		f.date = name[dp : dp+14]   // get the date portion
-		f.sha = name[dp+17 : dp+55] // get sha portion
+		f.sha = name[dp+15 : dp+55] // get sha portion
 		if f.ver == version || strings.HasPrefix(version, "v0.0.0-"+f.date+"-"+f.sha[:6]) || strings.HasPrefix(version, f.sha[:12]) {
-			f.path = path.Join(data.LocalCache, module, name)
-			f.dir = path.Join(data.LocalCache, module)
-			//fmt.Println("returned path", f.path, f.dir)
+			if ver, err := unescapeVersion(f.ver); err == nil {
+				f.ver = ver
+			}
+			f.path = path.Join(dir, module, name)
+			f.dir = path.Join(dir, module)
 			return &f
 		}
 	}
-	//fmt.Printf("failed checking cache for %s %s %#v\n", module, version, f)
 	return nil
 }
 
@@ -90,170 +160,325 @@ type lookupResult struct {
 	base, group, repo, path, majorVer   string
 	baseGroupRepo, groupRepo, cleanPath string
 	git                                 interface{}
+	backend                             *backend
+	conf                                *yamlParse // the config the lookup was made with
+	rule                                string     // name of the rule used
+	unprobed                            bool       // the groups are still to be probed for
+	projects                            *projectCache
+
+	// When set, the client's own credentials are used for the git server
+	passthrough         bool
+	gitURL, gitProvider string
 }
 
-func Lookup(pkg string) (lr *lookupResult, ok bool) {
-	// Switch the !c to a uppercase letter for safe url -> git repos
-	for i := strings.Index(pkg, "!"); i >= 0 && i+1 < len(pkg); i = strings.Index(pkg, "!") {
-		pkg = pkg[:i] + strings.ToUpper(pkg[i+1:i+2]) + pkg[i+2:]
+// setPath sets the folder of the module in the repo, splitting out a major
+// version if there is one.
+func (lr *lookupResult) setPath(p string) {
+	lr.path, lr.cleanPath, lr.majorVer = p, p, ""
+	verParts := strings.SplitN(p, "/", 2)
+	if len(verParts[0]) > 1 && verParts[0][0] == 'v' {
+		if _, err := strconv.ParseInt(verParts[0][1:], 10, 32); err == nil {
+			if len(verParts) > 1 {
+				lr.majorVer, lr.cleanPath = verParts[0], verParts[1]
+			} else {
+				lr.majorVer, lr.cleanPath = verParts[0], ""
+			}
+		}
 	}
+}
+
+// folders returns where the module may be in the repo, the first one with a
+// go.mod is taken: a major version has either its own folder (v2/) or the one
+// of the module.
+func (lr *lookupResult) folders() []string {
+	if lr.majorVer != "" && lr.path != lr.cleanPath {
+		return []string{lr.path, lr.cleanPath}
+	}
+	return []string{lr.cleanPath}
+}
+
+// Lookup finds where a module is, given its (unescaped) module path.  The
+// GitLab subgroups are not probed for, which is left to probeGroups.
+func (data *yamlParse) Lookup(ctx context.Context, pkg string) (lr *lookupResult, ok bool) {
+	return data.lookupWith(ctx, pkg, nil, nil)
+}
 
+// lookupWith finds where a module is, probing for GitLab subgroups with the
+// given git client and remembering the projects found in the cache, or the
+// shared one when nil.
+func (data *yamlParse) lookupWith(ctx context.Context, pkg string, probe interface{}, cache *projectCache) (lr *lookupResult, ok bool) {
 	// Do the absolute match first for references
-	lr = &lookupResult{orig: pkg}
+	lr = &lookupResult{orig: pkg, conf: data, projects: cache}
+	l := logOf(ctx, "lookup").With("module", pkg)
 	var out string
 	if out, ok = data.Modules[pkg]; ok {
-		if *verbose {
-			fmt.Println("switching from", pkg, "to", out)
-		}
+		l.Debug("Replacing module", "replacement", out)
 		pkg = out
 	}
 
 	if data.gitClient != nil {
-		lr.git, ok = data.gitClient, true
-		parts := strings.SplitN(pkg, "/", 4)
-		switch len(parts) {
-		case 1, 2:
-		case 3:
-			lr.base, lr.group, lr.repo = parts[0], parts[1], parts[2]
-		default:
-			lr.base, lr.group, lr.repo, lr.path, lr.cleanPath = parts[0], parts[1], parts[2], parts[3], parts[3]
-			{ // Split out a major version -- if there is one, first the start
-				verParts := strings.SplitN(parts[3], "/", 2)
-				if len(verParts[0]) > 1 && verParts[0][0] == 'v' {
-					if _, err := strconv.ParseInt(verParts[0][1:], 10, 32); err == nil {
-						if len(verParts) > 1 {
-							lr.majorVer, lr.cleanPath = verParts[0], verParts[1]
-						} else {
-							lr.majorVer, lr.cleanPath = verParts[0], ""
-						}
-					}
-				}
-			}
-			/*
-				if lr.majorVer == "" { // then the end
-					fol, ver := path.Split(parts[3])
-					fmt.Println("fol=", fol, "ver=", ver)
-					if len(ver) > 1 && ver[0] == 'v' {
-						if _, err := strconv.ParseInt(ver[1:], 10, 32); err == nil {
-							lr.majorVer, lr.cleanPath = ver, fol
-						}
-					}
-				}*/
-		}
+		lr.git, lr.backend, ok = data.gitClient, data.backend, true
+		lr.passthrough, lr.gitURL, lr.gitProvider = data.GitAuth == "passthrough", data.GitLabURL, data.GitLabProvider
+		lr.split(ctx, pkg, data.GroupDepth, probe)
+		lr.rule = "default"
 	}
 
-	// Loop over all the Regexp to find a match and then execute
-	for _, elm := range data.Regexp {
-		if elm.regexp.MatchString(pkg) {
-			ok = true
-			if elm.gitClient != nil { // return the best non-nil match
-				lr.git = elm.gitClient
-			} else {
-				lr.git = data.gitClient
-			}
+	// Find the rule for the module and then execute
+	if elm, match := data.findRule(pkg); elm != nil {
+		ok = true
+		lr.rule = elm.name()
+		if elm.gitClient != nil { // return the best non-nil match
+			lr.git, lr.backend = elm.gitClient, elm.backend
+			lr.passthrough, lr.gitURL, lr.gitProvider = elm.GitAuth == "passthrough", elm.GitLabURL, elm.GitLabProvider
+		} else {
+			lr.git, lr.backend = data.gitClient, data.backend
+			lr.passthrough, lr.gitURL, lr.gitProvider = data.GitAuth == "passthrough", data.GitLabURL, data.GitLabProvider
+		}
 
-			if elm.Base != "" {
-				lr.base = elm.regexp.ReplaceAllString(pkg, elm.Base)
-			}
-			if elm.Group != "" {
-				lr.group = elm.regexp.ReplaceAllString(pkg, elm.Group)
+		depth := elm.GroupDepth
+		if depth == "" {
+			depth = data.GroupDepth
+		}
+		if elm.regexp == nil { // prefix rule
+			mapped := pkg
+			if elm.Replace != "" {
+				mapped = strings.TrimSuffix(elm.Replace, "/") + pkg[match[1]:]
 			}
-			if elm.Repo != "" {
-				lr.repo = elm.regexp.ReplaceAllString(pkg, elm.Repo)
+			lr.split(ctx, mapped, depth, probe)
+		} else if elm.Replace != "" {
+			lr.split(ctx, elm.regexp.ReplaceAllString(pkg, elm.Replace), depth, probe)
+		} else {
+			// the module path as is, for what the templates leave out
+			lr.split(ctx, pkg, depth, probe)
+			if elm.Base != "" || elm.Group != "" || elm.Repo != "" {
+				// what follows the match is the folder in the repo
+				lr.setPath(strings.Trim(pkg[match[1]:], "/"))
 			}
+		}
+		expand := func(template string) string {
+			return string(elm.regexp.ExpandString(nil, template, pkg, match))
+		}
+		if elm.Base != "" {
+			lr.base = expand(elm.Base)
+		}
+		if elm.Group != "" {
+			lr.group = strings.Trim(expand(elm.Group), "/")
+		}
+		if elm.Repo != "" {
+			lr.repo = expand(elm.Repo)
 			if p := strings.SplitN(lr.repo, "/", 2); len(p) > 1 {
-				lr.repo, lr.path = p[0], p[1]
+				lr.repo = p[0]
+				lr.setPath(p[1])
 			}
-
-			if *verbose {
-				fmt.Println("in", pkg, "to b:", lr.base, "g:", lr.group, "r:", lr.repo)
-			}
-			break
 		}
+		if elm.Path != "" {
+			lr.setPath(strings.Trim(expand(elm.Path), "/"))
+		}
+
 	}
 	//	if lr.majorVer == "" {
 	lr.groupRepo = path.Join(lr.group, lr.repo)
 	lr.baseGroupRepo = path.Join(lr.base, lr.group, lr.repo)
 
-	if *verbose {
-		fmt.Printf("lr = %#v\n", lr)
+	if ok {
+		l.Debug("Found module", "rule", lr.rule, "git_url", lr.gitURL, "repo", lr.baseGroupRepo, "path", lr.cleanPath, "major", lr.majorVer)
 	}
 	return
 }
 
+// loadConfig reads in the config at startup and sets up what cannot be
+// changed by a reload.
 func loadConfig() {
-	// reading mapping from yaml file
-	if *verbose {
-		log.Println("Loading in config", *configFile)
-	}
-	cfg, err := ioutil.ReadFile(*configFile)
+	c, err := parseConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	current.Store(c)
+
+	setClientAuth(c)
+	setTLSPolicy(&c.TLS)
+	if err = loadCertificates(c); err != nil {
+		log.Fatal(err)
+	}
+	if c.Ledger != "" {
+		loadLedger(c.Ledger)
+	}
+	loadAudit(c)
+	loadProbes(c)
+}
+
+// parseConfig reads in and validates a config file, and connects the git
+// clients.  Nothing global is changed so a bad config can be rejected.
+func parseConfig(file string) (*yamlParse, error) {
+	// reading mapping from yaml file
+	configLogger.Debug("Loading in config", "file", file)
+	cfg, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
 
 	// load config
-	err = yaml.Unmarshal(cfg, &data)
+	c := &yamlParse{}
+	err = yaml.Unmarshal(cfg, c)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	if configLogger.Enabled(levelDebug) {
+		adat, _ := json.Marshal(c)
+		configLogger.Debug("Parsed config", "config", string(adat), "modules", len(c.Modules), "rules", len(c.Regexp))
+	}
+
+	switch c.LedgerPolicy {
+	case "", "refuse", "alert":
+	default:
+		return nil, fmt.Errorf("unknown ledger-policy %q, expected refuse or alert", c.LedgerPolicy)
+	}
+	if _, _, err = c.TLS.policy(); err != nil {
+		return nil, err
+	}
+	if err = c.loadOIDC(); err != nil {
+		return nil, err
+	}
+	if err = c.loadAccess(); err != nil {
+		return nil, err
+	}
+	if err = c.loadListeners(); err != nil {
+		return nil, err
 	}
 
-	if *verbose {
-		adat, _ := json.MarshalIndent(data, "", "  ")
-		fmt.Println(string(adat))
+	if err = checkGitAuth(c.GitAuth); err != nil {
+		return nil, err
+	}
+	if err = checkGroupDepth(c.GroupDepth); err != nil {
+		return nil, err
+	}
+	if c.MaxGroupDepth == 0 {
+		c.MaxGroupDepth = defaultMaxGroupDepth
+	} else if c.MaxGroupDepth < 1 {
+		return nil, fmt.Errorf("invalid max-group-depth %d, expected a number of groups", c.MaxGroupDepth)
+	}
+	for _, elm := range c.Regexp {
+		if err = checkGitAuth(elm.GitAuth); err != nil {
+			return nil, err
+		}
+		if err = checkGroupDepth(elm.GroupDepth); err != nil {
+			return nil, err
+		}
+	}
 
-		log.Println("Found", len(data.Modules), "exact module replacements")
-		log.Println("Found", len(data.Regexp), "regexp match (and replace) module replacements")
+	if c.GitLabToken, err = loadSecret(c.GitLabToken, c.GitHelper, c.GitLabURL); err != nil {
+		return nil, fmt.Errorf("error reading git-token: %w", err)
+	}
+	if err = loadSecrets(c.GitTokens, c.GitLabURL); err != nil {
+		return nil, fmt.Errorf("error reading git-tokens: %w", err)
+	}
+	for i, elm := range c.Regexp {
+		if c.Regexp[i].GitLabToken, err = loadSecret(elm.GitLabToken, elm.GitHelper, elm.GitLabURL); err != nil {
+			return nil, fmt.Errorf("error reading git-token of %q: %w", elm.Match, err)
+		}
+		if err = loadSecrets(elm.GitTokens, elm.GitLabURL); err != nil {
+			return nil, fmt.Errorf("error reading git-tokens of %q: %w", elm.Match, err)
+		}
 	}
 
 	// initialization of Gitlab client(s)
-	if data.GitLabURL != "" {
-		if *verbose {
-			log.Println("Connecting to", data.GitLabURL)
+	if c.GitLabURL != "" {
+		configLogger.Debug("Connecting to git server", "url", c.GitLabURL)
+		if c.backend, err = newBackend(c.Transport, c.GitLabURL); err != nil {
+			return nil, fmt.Errorf("transport of %s: %w", c.GitLabURL, err)
 		}
-		data.gitClient = login(data.GitLabToken, data.GitLabURL, data.GitLabProvider)
+		c.gitClient, err = login(append([]*secret{c.GitLabToken}, c.GitTokens...), c.GitLabURL, c.GitLabProvider, c.backend)
 		if err != nil {
-			log.Fatal("Error connecting to git:", data.GitLabURL, err)
-			log.Fatal(err)
+			return nil, fmt.Errorf("error connecting to git %s: %w", c.GitLabURL, err)
 		}
 	}
 
-	for i, elm := range data.Regexp {
-		if *verbose {
-			log.Println("Compiling regexp for", elm.Match)
+	for i, elm := range c.Regexp {
+		if elm.Match != "" {
+			configLogger.Debug("Compiling regexp", "match", elm.Match)
 		}
-		data.Regexp[i].regexp, err = regexp.Compile(elm.Match)
-		if err != nil {
-			log.Fatal("Error compiling match:", elm.Match, err)
+		if err = c.Regexp[i].compile(c.GitLabProvider); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", elm.name(), err)
 		}
 
 		if elm.GitLabURL != "" {
-			if *verbose {
-				log.Println("Connecting to", elm.GitLabURL)
+			configLogger.Debug("Connecting to git server", "url", elm.GitLabURL, "rule", elm.name())
+			transport := elm.Transport
+			if transport == nil {
+				transport = c.Transport
+			}
+			if c.Regexp[i].backend, err = newBackend(transport, elm.GitLabURL); err != nil {
+				return nil, fmt.Errorf("transport of %s: %w", elm.GitLabURL, err)
+			}
+			c.Regexp[i].gitClient, err = login(append([]*secret{c.Regexp[i].GitLabToken}, elm.GitTokens...), elm.GitLabURL, elm.GitLabProvider, c.Regexp[i].backend)
+			if err != nil {
+				return nil, fmt.Errorf("error connecting to git %s: %w", elm.GitLabURL, err)
+			}
+		}
+	}
+	c.loadRules()
+	if err = c.runTests(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkTemplate makes sure the groups used in a template are in the regexp.
+func checkTemplate(re *regexp.Regexp, template string) error {
+	for i := strings.Index(template, "$"); i >= 0; i = strings.Index(template, "$") {
+		template = template[i+1:]
+		var name string
+		switch {
+		case strings.HasPrefix(template, "$"):
+			template = template[1:]
+			continue
+		case strings.HasPrefix(template, "{"):
+			end := strings.Index(template, "}")
+			if end < 0 {
+				return fmt.Errorf("unclosed ${ in template")
 			}
-			c := github.NewTokenClient(ctx, elm.GitLabToken)
-			if *verbose {
-				fmt.Printf("github client: %#v\n", c)
+			name, template = template[1:end], template[end+1:]
+		default:
+			end := strings.IndexFunc(template, func(r rune) bool {
+				return !(r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+			})
+			if end < 0 {
+				end = len(template)
 			}
-			data.Regexp[i].gitClient = login(elm.GitLabToken, elm.GitLabURL, elm.GitLabProvider)
+			name, template = template[:end], template[end:]
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			if n > re.NumSubexp() {
+				return fmt.Errorf("template uses group $%d, the regexp has %d", n, re.NumSubexp())
+			}
+		} else if name == "" || re.SubexpIndex(name) < 0 {
+			return fmt.Errorf("template uses unknown group %q, use ${1} or ${name} when followed by text", name)
 		}
 	}
+	return nil
 }
 
-func login(tok, apiurl, prov string) interface{} {
+func login(tokens []*secret, apiurl, prov string, b *backend) (interface{}, error) {
+	transport := &tokenTransport{pool: newTokenPool(tokens),
+		base: &upstreamTransport{provider: prov, base: b.roundTripper()}}
 	switch prov {
 	case "offline":
-		return struct{}{}
+		return struct{}{}, nil
 	case "gitlab":
-		c, err := gitlab.NewClient(tok, gitlab.WithBaseURL(apiurl))
+		// The transport retries, with the next token when rate limited
+		transport.header = "PRIVATE-TOKEN"
+		c, err := gitlab.NewClient("", gitlab.WithBaseURL(apiurl),
+			gitlab.WithHTTPClient(&http.Client{Transport: transport}), gitlab.WithoutRetries())
 		if err != nil {
-			log.Fatal("Error connecting to gitlab:", apiurl, err)
+			return nil, err
 		}
-		return c
+		return c, nil
 	case "github":
-		c := github.NewTokenClient(ctx, tok)
+		c := github.NewClient(&http.Client{Transport: transport})
 		baseEndpoint, err := url.Parse(apiurl)
 		if err != nil {
-			log.Fatal("unable to parse url", apiurl)
+			return nil, fmt.Errorf("unable to parse url %q: %w", apiurl, err)
 		}
 		if !strings.HasSuffix(baseEndpoint.Path, "/") {
 			baseEndpoint.Path += "/"
@@ -268,12 +493,7 @@ func login(tok, apiurl, prov string) interface{} {
 		//if err != nil {
 		//	log.Fatal("Error querying git metadata:", apiurl, err)
 		//}
-		//if *verbose {
-		//	fmt.Println("meta:", *meta)
-		//}
-		return c
-	default:
-		log.Fatal("Unknown provider ", prov, " for ", apiurl)
+		return c, nil
 	}
-	return nil
+	return nil, fmt.Errorf("unknown provider %q for %s", prov, apiurl)
 }
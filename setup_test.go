@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestCheckCache(t *testing.T) {
+	const (
+		m      = "gitlab.com/grp/repo"
+		tagged = "5e8b1f0c7a2d4e6f8091a2b3c4d5e6f708192a3b"
+		branch = "23464f67efb2c3d4e5f60718293a4b5c6d7e8f90"
+	)
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, m), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"v1.2.0" + "20230301120000-" + tagged + ".tgz",
+		"20230302120000-" + branch + ".tgz",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, m, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		version string
+		sha     string
+	}{
+		{"v1.2.0", tagged},
+		{"v0.0.0-20230302120000-23464f67efb2", branch},
+		{"v0.0.0-20230302120000-23464f67efb2+incompatible", branch},
+		{"23464f67efb2", branch},
+		{"5e8b1f0c7a2d", tagged},
+		{"v1.3.0", ""},
+		{"v0.0.0-20230302120000-5e8b1f0c7a2d", ""},
+		{"23464f67", ""}, // too short to be told apart
+	}
+	for _, tt := range tests {
+		f := checkCache(dir, m, tt.version)
+		switch {
+		case f == nil && tt.sha != "":
+			t.Errorf("checkCache(%q) = nil, want commit %s", tt.version, tt.sha)
+		case f != nil && f.sha != tt.sha:
+			t.Errorf("checkCache(%q) = commit %s, want %q", tt.version, f.sha, tt.sha)
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	re := regexp.MustCompile(`company\.com/(?P<team>[^/]+)/([^/]+)`)
+	tests := []struct {
+		template string
+		ok       bool
+	}{
+		{"", true},
+		{"gitlab.corp/go", true},
+		{"$1", true},
+		{"$2", true},
+		{"${2}-go", true},
+		{"$team", true},
+		{"${team}/go", true},
+		{"gitlab.corp/$team/$2", true},
+		{"$$1", true}, // a literal $
+		{"$3", false},
+		{"${3}", false},
+		{"$user", false},
+		{"$1go", false}, // the group would be "1go"
+		{"${team", false},
+		{"${}", false},
+		{"$", false},
+	}
+	for _, tt := range tests {
+		if err := checkTemplate(re, tt.template); (err == nil) != tt.ok {
+			t.Errorf("checkTemplate(%q) = %v, want ok %t", tt.template, err, tt.ok)
+		}
+	}
+}
+
+func TestLookupRegexpRule(t *testing.T) {
+	// No default git-url, so nothing is mapped but by the rules
+	data := &yamlParse{Regexp: []yamlMatchReplace{
+		{Match: `company\.com/(?P<team>[^/]+)/(?P<name>[^/]+)`, Base: "gitlab.corp", Group: "go/$team", Repo: "$name"},
+		{Match: `other\.org/(.*)`, Replace: "gitlab.corp/mirror/$1"},
+		{Match: `plain\.org/.*`},
+	}}
+	for i := range data.Regexp {
+		if err := data.Regexp[i].compile(""); err != nil {
+			t.Fatal(err)
+		}
+		data.Regexp[i].gitClient = struct{}{}
+	}
+	data.loadRules()
+
+	tests := []struct {
+		module                  string
+		base, group, repo, path string
+	}{
+		{"company.com/a/b/c", "gitlab.corp", "go/a", "b", "c"},
+		{"other.org/grp/repo/pkg", "gitlab.corp", "mirror", "grp", "repo/pkg"},
+		{"plain.org/grp/repo/pkg", "plain.org", "grp", "repo", "pkg"},
+	}
+	for _, tt := range tests {
+		lr, ok := data.Lookup(context.Background(), tt.module)
+		if !ok {
+			t.Errorf("Lookup(%q) found nothing", tt.module)
+			continue
+		}
+		if lr.base != tt.base || lr.group != tt.group || lr.repo != tt.repo || lr.path != tt.path {
+			t.Errorf("Lookup(%q) = %s %s %s %s, want %s %s %s %s", tt.module,
+				lr.base, lr.group, lr.repo, lr.path, tt.base, tt.group, tt.repo, tt.path)
+		}
+	}
+}
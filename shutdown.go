@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	drainTimeout = flag.Duration("drain", 2*time.Minute, "How long requests in flight may take to finish on shutdown")
+	writeTimeout = flag.Duration("write-timeout", 30*time.Minute, "Longest time to answer a request, such as sending a large module zip")
+)
+
+var mainLogger = newLogger("main")
+
+// Set once a shutdown started, so the readiness check fails.
+var shuttingDown int32
+
+// serve runs the servers until SIGTERM or SIGINT.  Then no new connections
+// are taken and the requests in flight may finish until the drain timeout, or
+// a second signal, after which the connections are closed and the upstream
+// fetches canceled.  The partial cache files are removed before returning.
+func serve(endpoints []*endpoint) {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	errc := make(chan error, len(endpoints))
+	for _, e := range endpoints {
+		e := e
+		go func() { errc <- e.server.Serve(e.ln) }()
+	}
+
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case sig := <-stop:
+		mainLogger.Info("Draining the requests in flight", "signal", sig, "for", *drainTimeout)
+	}
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	drain, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			mainLogger.Info("Got a second signal, closing now")
+			cancel()
+		case <-drain.Done():
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, e := range endpoints {
+		e := e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.server.Shutdown(drain); err != nil {
+				mainLogger.Warn("Closing the requests still in flight", "address", e.conf.Address, "err", err)
+				e.server.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	cancelUpstream()
+	waitFetches(10 * time.Second)
+	removePartials()
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	mainLogger.Info("Shut down")
+}
+
+// waitFetches waits a while for the canceled upstream fetches to clean up.
+func waitFetches(limit time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		fetches.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(limit):
+	}
+}
+
+// The temporary files being written, so the ones left when shutting down can
+// be removed.
+var partials struct {
+	sync.Mutex
+	m map[string]struct{}
+}
+
+// createTemp is os.CreateTemp for files which are renamed or removed with
+// removeTemp once done.
+func createTemp(dir, pattern string) (*os.File, error) {
+	fh, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	partials.Lock()
+	if partials.m == nil {
+		partials.m = make(map[string]struct{})
+	}
+	partials.m[fh.Name()] = struct{}{}
+	partials.Unlock()
+	return fh, nil
+}
+
+// removeTemp removes a temporary file, if it was not renamed.
+func removeTemp(name string) {
+	os.Remove(name)
+	partials.Lock()
+	delete(partials.m, name)
+	partials.Unlock()
+}
+
+func removePartials() {
+	partials.Lock()
+	defer partials.Unlock()
+	for name := range partials.m {
+		if err := os.Remove(name); err == nil {
+			mainLogger.Debug("Removed partial file", "file", name)
+		}
+		delete(partials.m, name)
+	}
+}
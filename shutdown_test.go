@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeDrains(t *testing.T) {
+	savedDrain := *drainTimeout
+	*drainTimeout = 5 * time.Second
+	t.Cleanup(func() {
+		*drainTimeout = savedDrain
+		atomic.StoreInt32(&shuttingDown, 0)
+		baseCtx, cancelUpstream = context.WithCancel(context.Background())
+	})
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first half, "))
+		w.(http.Flusher).Flush()
+		close(entered)
+		<-release
+		w.Write([]byte("second half"))
+	})}
+	partial, err := createTemp(t.TempDir(), tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial.Close()
+
+	served := make(chan struct{})
+	go func() {
+		serve([]*endpoint{{conf: yamlListener{Address: ln.Addr().String()}, ln: ln, server: server}})
+		close(served)
+	}()
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-entered
+
+	// Once signaled, not ready and no new connections, while the request in
+	// flight finishes
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	for deadline := time.Now().Add(5 * time.Second); checkReady().Ready; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("still ready after SIGTERM")
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("new connections taken while draining")
+		}
+	}
+	close(release)
+	if got := <-body; got != "first half, second half" {
+		t.Errorf("request in flight got %q", got)
+	}
+
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+		t.Fatal("not shut down")
+	}
+	if baseCtx.Err() == nil {
+		t.Error("upstream fetches not canceled")
+	}
+	if _, err := os.Stat(partial.Name()); !os.IsNotExist(err) {
+		t.Error("partial file left", err)
+	}
+}
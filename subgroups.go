@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// How long the probed existence of a GitLab project is remembered, and how
+// many groups are probed by default.
+const (
+	projectFoundTTL      = time.Hour
+	projectMissingTTL    = 5 * time.Minute
+	defaultMaxGroupDepth = 4
+)
+
+type projectEntry struct {
+	exists bool
+	at     time.Time
+}
+
+func (e projectEntry) fresh() bool {
+	if e.exists {
+		return time.Since(e.at) < projectFoundTTL
+	}
+	return time.Since(e.at) < projectMissingTTL
+}
+
+// The projects found by probing, by git server, with the shared clients.  The
+// clients with the credentials of a user have their own.
+type projectCache struct {
+	sync.Mutex
+	m      map[string]projectEntry
+	pruned time.Time
+}
+
+var projects projectCache
+
+func (c *projectCache) get(key string) (projectEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.m[key]
+	return e, ok && e.fresh()
+}
+
+func (c *projectCache) put(key string, e projectEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]projectEntry)
+	}
+	if time.Since(c.pruned) > projectMissingTTL {
+		for k, old := range c.m {
+			if !old.fresh() {
+				delete(c.m, k)
+			}
+		}
+		c.pruned = time.Now()
+	}
+	c.m[key] = e
+}
+
+func checkGroupDepth(depth string) error {
+	if depth == "" || depth == "probe" {
+		return nil
+	}
+	if n, err := strconv.Atoi(depth); err != nil || n < 1 {
+		return fmt.Errorf("unknown group-depth %q, expected a number of groups or probe", depth)
+	}
+	return nil
+}
+
+// split sets the parts of the lookup from a module path of the form
+// host/group/repo/path, where the group is made of the given number of
+// groups, or as many as found by probing for the project with the git
+// client.  Without a client the probing is left to probeGroups.
+func (lr *lookupResult) split(ctx context.Context, pkg, depth string, probe interface{}) {
+	parts := strings.Split(pkg, "/")
+	lr.base, lr.group, lr.repo = "", "", ""
+	lr.setPath("")
+	lr.unprobed = false
+	if len(parts) < 3 {
+		return
+	}
+	groups := 1
+	switch depth {
+	case "", "1":
+	case "probe":
+		if probe == nil {
+			lr.unprobed = true
+		} else {
+			groups = lr.probeDepth(ctx, probe, parts)
+		}
+	default:
+		groups, _ = strconv.Atoi(depth)
+	}
+	if groups > len(parts)-2 {
+		groups = len(parts) - 2
+	}
+	lr.base = parts[0]
+	lr.group = strings.Join(parts[1:1+groups], "/")
+	lr.repo = parts[1+groups]
+	lr.setPath(strings.Join(parts[2+groups:], "/"))
+}
+
+// probeGroups finds the groups of the module when the lookup left the probing
+// out, once the request may use the git client of the lookup.
+func (lr *lookupResult) probeGroups(ctx context.Context) {
+	if !lr.unprobed {
+		return
+	}
+	git, cache := lr.git, lr.projects
+	found, _ := lr.conf.lookupWith(ctx, lr.orig, git, cache)
+	*lr = *found
+	lr.git = git // may be the one with the client's credentials
+}
+
+// probeDepth finds the longest prefix of the module path which is a project
+// on the GitLab server, up to max-group-depth groups, and returns the number
+// of groups it is in.
+func (lr *lookupResult) probeDepth(ctx context.Context, git interface{}, parts []string) int {
+	client, ok := git.(*gitlab.Client)
+	if !ok {
+		return 1
+	}
+	groups := len(parts) - 2
+	if max := lr.conf.MaxGroupDepth; groups > max {
+		groups = max
+	}
+	for ; groups > 1; groups-- {
+		if lr.projectExists(ctx, client, strings.Join(parts[1:groups+2], "/")) {
+			return groups
+		}
+	}
+	return 1
+}
+
+// projectExists asks the GitLab server whether the project exists.  The
+// answers depend on the credentials, so the ones of a user's client are kept
+// with it.
+func (lr *lookupResult) projectExists(ctx context.Context, client *gitlab.Client, project string) bool {
+	cache := lr.projects
+	if cache == nil {
+		cache = &projects
+	}
+	key := lr.gitURL + "\x00" + project
+	if e, ok := cache.get(key); ok {
+		return e.exists
+	}
+
+	_, resp, err := client.Projects.GetProject(project, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return false // do not remember failures of the server
+	}
+	cache.put(key, projectEntry{exists: err == nil, at: time.Now()})
+	return err == nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestProbeGroups(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasPrefix(r.URL.Path, "/api/v4/projects/") {
+			return // go-gitlab asks for the rate limit first
+		}
+		calls++
+		if r.URL.EscapedPath() == "/api/v4/projects/grp%2Fsub%2Frepo" {
+			w.Write([]byte(`{"id": 1}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "404 Project Not Found"}`))
+	}))
+	defer srv.Close()
+	client, err := gitlab.NewClient("", gitlab.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &yamlParse{GitLabURL: srv.URL, GroupDepth: "probe", MaxGroupDepth: 4, gitClient: client}
+	data.loadRules()
+	t.Cleanup(func() { projects = projectCache{} })
+
+	var user projectCache
+	steps := []struct {
+		cache *projectCache
+		calls int
+	}{
+		{nil, 2},   // grp/sub/repo/pkg is not a project, grp/sub/repo is
+		{nil, 0},   // remembered
+		{&user, 2}, // not with the credentials of a user
+		{&user, 0},
+	}
+	for i, s := range steps {
+		calls = 0
+		lr, _ := data.lookupWith(context.Background(), "company.com/grp/sub/repo/pkg", client, s.cache)
+		if lr.group != "grp/sub" || lr.repo != "repo" || lr.path != "pkg" {
+			t.Errorf("step %d: found group %q, repo %q, path %q", i+1, lr.group, lr.repo, lr.path)
+		}
+		if calls != s.calls {
+			t.Errorf("step %d: %d calls to the git server, want %d", i+1, calls, s.calls)
+		}
+	}
+
+	// Entries past their time are dropped from the cache
+	user.put("old", projectEntry{exists: true, at: time.Now().Add(-2 * projectFoundTTL)})
+	user.pruned = time.Time{}
+	user.put("new", projectEntry{exists: true, at: time.Now()})
+	if _, ok := user.m["old"]; ok {
+		t.Error("expired project entry not pruned")
+	}
+	if _, ok := user.get("new"); !ok {
+		t.Error("project entry not found")
+	}
+}
@@ -1,120 +1,85 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"archive/zip"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"hash"
 	"io"
-	"log"
 	"net/http"
+	"os"
 	"sort"
 	"strings"
-
-	"github.com/google/go-github/v50/github"
-	"github.com/gorilla/mux"
-	"github.com/pschou/go-tease"
-	"github.com/xanzy/go-gitlab"
 )
 
 func sum(w http.ResponseWriter, r *http.Request) {
-	if *verbose {
-		log.Printf("Got archive request: %#v", r)
-	}
 	// find a project ID by module name
-	module := mux.Vars(r)["module"]
-	lr, ok := Lookup(module)
+	module, version, ok := requestModule(w, r)
+	if !ok {
+		return
+	}
+	lr, ok := lookup(w, r, module)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	if !useClientCredentials(w, r, lr) {
+		return
+	}
 
-	ver, notice := getVersion(lr, mux.Vars(r)["version"])
+	ver, notice, err := getVersion(r.Context(), lr, version)
+	if err != nil {
+		upstreamError(w, err)
+		return
+	}
 	if notice != "" {
 		http.Error(w, notice, http.StatusNotFound)
 		return
 	}
+	auditOf(r).version(&ver)
 
-	switch client := lr.git.(type) {
-	case *gitlab.Client:
-		pr, pw := io.Pipe()
-
-		var clientErr error
-		go func() {
-			format := "tar.gz"
-			_, clientErr = client.Repositories.StreamArchive(lr.groupRepo, pw, &gitlab.ArchiveOptions{
-				Format: &format,
-				SHA:    &ver.Origin.Hash,
-			})
-			pw.Close()
-		}()
-
-		pr.Read([]byte{}) // trigger a short read
-		if clientErr != nil {
-			http.Error(w, clientErr.Error(), http.StatusInternalServerError)
+	if lr.conf.LocalCache != "" { // use the hashes recorded when the zip was built
+		_, hit := cachedArtifacts(lr, module, ver.Version)
+		auditOf(r).cache(hit)
+		a, err := ensureArtifacts(r.Context(), lr, &ver, module)
+		if err != nil {
+			upstreamError(w, err)
 			return
 		}
-
-		var rdr *tar.Reader
-		tr := tease.NewReader(pr)
-
-		gz, err := gzip.NewReader(tr)
-		if err == nil {
-			rdr = tar.NewReader(gz)
-			tr.Pipe()
-		} else {
-			tr.Seek(0, io.SeekStart)
-			rdr = tar.NewReader(tr)
-			tr.Pipe()
-		}
-
-		pkg, mod := modsum(rdr, module, ver.Version)
-		if pkg != "" {
-			fmt.Fprintf(w, "%s %s h1:%s\n", module, ver.Version, pkg)
-		}
-		if mod != "" {
-			fmt.Fprintf(w, "%s %s/go.mod h1:%s\n", module, ver.Version, mod)
-		}
-
-	case *github.Client:
-		link, _, err := client.Repositories.GetArchiveLink(ctx, lr.group, lr.repo, github.Tarball,
-			&github.RepositoryContentGetOptions{Ref: ver.Origin.Hash}, true)
+		pkg, err := readZipHash(a)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fmt.Println("got link: ", link)
-
-		resp, err := http.Get(link.String())
+		gomod, err := os.ReadFile(a.mod)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer resp.Body.Close()
-
-		var rdr *tar.Reader
-		tr := tease.NewReader(resp.Body)
+		fmt.Fprintf(w, "%s %s h1:%s\n", module, ver.Version, pkg)
+		fmt.Fprintf(w, "%s %s/go.mod h1:%s\n", module, ver.Version, hashMod(gomod))
+		return
+	}
 
-		gz, err := gzip.NewReader(tr)
-		if err == nil {
-			rdr = tar.NewReader(gz)
-			tr.Pipe()
-		} else {
-			tr.Seek(0, io.SeekStart)
-			rdr = tar.NewReader(tr)
-			tr.Pipe()
-		}
+	fh, err := fetchArchive(r.Context(), lr, &ver)
+	if err != nil {
+		upstreamError(w, err)
+		return
+	}
+	defer fh.Close()
 
-		pkg, mod := modsum(rdr, module, ver.Version)
-		if pkg != "" {
-			fmt.Fprintf(w, "%s %s h1:%s\n", module, ver.Version, pkg)
-		}
-		if mod != "" {
-			fmt.Fprintf(w, "%s %s/go.mod h1:%s\n", module, ver.Version, mod)
-		}
+	pkg, mod, err := modsum(r.Context(), fh, lr, module, ver.Version)
+	if err == nil {
+		err = ledgerCheck(lr, ledgerEntry{Module: lr.orig, Version: ver.Version, Hash: ver.Origin.Hash, Sum: pkg, ModSum: mod})
 	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s %s h1:%s\n", module, ver.Version, pkg)
+	fmt.Fprintf(w, "%s %s/go.mod h1:%s\n", module, ver.Version, mod)
 }
 
 type fileSum struct {
@@ -122,39 +87,27 @@ type fileSum struct {
 	hash hash.Hash
 }
 
-func modsum(tr *tar.Reader, module, finalVersion string) (pkg, mod string) {
-	var item *tar.Header
-	directory := fmt.Sprintf("%s@%s", module, finalVersion)
-
-	var fileSums []fileSum
-	var err error
-
-	// read unpacked files into hash, with changed folder name
-	for item, err = tr.Next(); err == nil; item, err = tr.Next() {
-		//fmt.Println("tar item:", item)
-		parts := strings.SplitN(item.Name, "/", 2)
-		if len(parts) == 1 || item.Typeflag != tar.TypeReg {
-			continue
-		}
-
-		fs := fileSum{
-			name: directory + "/" + parts[1],
-			hash: sha256.New(),
-		}
-
-		io.Copy(fs.hash, tr)
-		fileSums = append(fileSums, fs)
-
-		if parts[1] == "go.mod" {
-			modHash := sha256.New()
-			fmt.Fprintf(modHash, "%0x  %s\n", fs.hash.Sum(nil), "go.mod")
-			mod = base64.StdEncoding.EncodeToString(modHash.Sum(nil))
-		}
-	}
-	if err != nil && err != io.EOF {
+// modsum computes the h1: hashes of the module zip and go.mod which are
+// built from the tarball.
+func modsum(ctx context.Context, r io.ReadSeeker, lr *lookupResult, module, finalVersion string) (pkg, mod string, err error) {
+	gomod, fileSums, err := buildZip(ctx, io.Discard, r, module, lr.folders(), finalVersion)
+	if err != nil {
 		return
 	}
+	return hashFiles(fileSums), hashMod(moduleFile(gomod, lr)), nil
+}
+
+// moduleFile returns the go.mod to serve, one is made up for repositories
+// without one.
+func moduleFile(gomod []byte, lr *lookupResult) []byte {
+	if gomod == nil {
+		return []byte(fmt.Sprintf("module %s\n", lr.orig))
+	}
+	return gomod
+}
 
+// hashFiles computes the h1: directory hash over the summed files.
+func hashFiles(fileSums []fileSum) string {
 	// Sort the files by name
 	sort.Slice(fileSums, func(i, j int) bool {
 		return strings.Compare(fileSums[i].name, fileSums[j].name) < 0
@@ -163,9 +116,34 @@ func modsum(tr *tar.Reader, module, finalVersion string) (pkg, mod string) {
 	// Hash it all
 	dirHash := sha256.New()
 	for _, f := range fileSums {
-		//fmt.Println("%0x  %s\n", f.hash.Sum(nil), f.name)
 		fmt.Fprintf(dirHash, "%0x  %s\n", f.hash.Sum(nil), f.name)
 	}
-	pkg = base64.StdEncoding.EncodeToString(dirHash.Sum(nil))
-	return
+	return base64.StdEncoding.EncodeToString(dirHash.Sum(nil))
+}
+
+// hashZip computes the h1: hash of a module zip, as done by the go command.
+func hashZip(zr *zip.Reader) (string, error) {
+	var fileSums []fileSum
+	for _, zf := range zr.File {
+		fs := fileSum{name: zf.Name, hash: sha256.New()}
+		rc, err := zf.Open()
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(fs.hash, rc)
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+		fileSums = append(fileSums, fs)
+	}
+	return hashFiles(fileSums), nil
+}
+
+// hashMod computes the h1: hash of a go.mod file.
+func hashMod(content []byte) string {
+	fileHash := sha256.Sum256(content)
+	modHash := sha256.New()
+	fmt.Fprintf(modHash, "%0x  %s\n", fileHash, "go.mod")
+	return base64.StdEncoding.EncodeToString(modHash.Sum(nil))
 }
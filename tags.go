@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+// semver is a version as the go command takes them from tags: vX.Y.Z with an
+// optional pre-release, without build metadata.
+type semver struct {
+	major, minor, patch uint64
+	pre                 string
+}
+
+func parseSemver(v string) (s semver, ok bool) {
+	if !strings.HasPrefix(v, "v") || strings.Contains(v, "+") {
+		return
+	}
+	core, pre, hasPre := strings.Cut(v[1:], "-")
+	if hasPre && pre == "" {
+		return
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return
+	}
+	for i, n := range []*uint64{&s.major, &s.minor, &s.patch} {
+		if parts[i] == "" || len(parts[i]) > 1 && parts[i][0] == '0' {
+			return
+		}
+		var err error
+		if *n, err = strconv.ParseUint(parts[i], 10, 64); err != nil {
+			return
+		}
+	}
+	s.pre = pre
+	return s, true
+}
+
+// less orders the versions by precedence, a pre-release comes before its
+// release.
+func (s semver) less(o semver) bool {
+	switch {
+	case s.major != o.major:
+		return s.major < o.major
+	case s.minor != o.minor:
+		return s.minor < o.minor
+	case s.patch != o.patch:
+		return s.patch < o.patch
+	case s.pre == "" || o.pre == "":
+		return s.pre != "" && o.pre == ""
+	}
+	a, b := strings.Split(s.pre, "."), strings.Split(o.pre, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		na, errA := strconv.ParseUint(a[i], 10, 64)
+		nb, errB := strconv.ParseUint(b[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			return na < nb
+		case errA == nil || errB == nil:
+			return errA == nil // numbers come first
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
+
+// tagVersion gives the version of the module a tag is for, if it is.  The
+// tags of a module in a folder of the repo are prefixed with it (sub/v1.0.0),
+// and the major version must be the one of the module path.
+func (lr *lookupResult) tagVersion(tag string) (version string, s semver, ok bool) {
+	version = tag
+	if lr.cleanPath != "" {
+		if !strings.HasPrefix(tag, lr.cleanPath+"/") {
+			return "", s, false
+		}
+		version = tag[len(lr.cleanPath)+1:]
+	}
+	if s, ok = parseSemver(version); !ok {
+		return "", s, false
+	}
+	if lr.majorVer == "" {
+		ok = s.major <= 1
+	} else {
+		ok = "v"+strconv.FormatUint(s.major, 10) == lr.majorVer
+	}
+	return version, s, ok
+}
+
+// tagName is the tag of a version of the module.
+func (lr *lookupResult) tagName(version string) string {
+	if lr.cleanPath != "" {
+		return lr.cleanPath + "/" + version
+	}
+	return version
+}
+
+// isPseudoVersion tells the versions made up for a commit, which end with its
+// date and hash: v0.0.0-20230301140000-66fa6bbf0023.
+func isPseudoVersion(v string) bool {
+	hyphen := strings.LastIndex(v, "-")
+	return hyphen >= 20 && len(v) >= 34 && hyphen < len(v)-4
+}
+
+type moduleTag struct {
+	version string
+	semver  semver
+	hash    string
+}
+
+// moduleTags lists the tags of the module with their commits, the highest
+// version first.
+func (lr *lookupResult) moduleTags(ctx context.Context) (tags []moduleTag, err error) {
+	add := func(name, hash string) {
+		if version, s, ok := lr.tagVersion(name); ok && hash != "" && !isPseudoVersion(version) {
+			tags = append(tags, moduleTag{version, s, hash})
+		}
+	}
+	switch client := lr.git.(type) {
+	case *gitlab.Client:
+		list, _, err := client.Tags.ListTags(lr.groupRepo,
+			&gitlab.ListTagsOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range list {
+			if tag.Commit != nil {
+				add(tag.Name, tag.Commit.ID)
+			}
+		}
+	case *github.Client:
+		list, _, err := client.Repositories.ListTags(ctx, lr.group, lr.repo, &github.ListOptions{PerPage: 100})
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range list {
+			add(tag.GetName(), tag.GetCommit().GetSHA())
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[j].semver.less(tags[i].semver) })
+	return tags, nil
+}
+
+// descends tells whether the commit comes after the tagged one.
+func (lr *lookupResult) descends(ctx context.Context, hash, tagHash string) (bool, error) {
+	switch client := lr.git.(type) {
+	case *gitlab.Client:
+		base, _, err := client.Repositories.MergeBase(lr.groupRepo,
+			&gitlab.MergeBaseOptions{Ref: &[]string{tagHash, hash}}, gitlab.WithContext(ctx))
+		if err != nil {
+			return false, err
+		}
+		return base.ID == tagHash, nil
+	case *github.Client:
+		cmp, _, err := client.Repositories.CompareCommits(ctx, lr.group, lr.repo, tagHash, hash, nil)
+		if err != nil {
+			return false, err
+		}
+		return cmp.GetStatus() == "ahead" || cmp.GetStatus() == "identical", nil
+	}
+	return false, nil
+}
+
+// commitVersion names a commit asked for by branch or hash as the go command
+// does: by the highest tag of the module on it, or else by a pseudo-version
+// after the highest tag it comes after.
+func (lr *lookupResult) commitVersion(ctx context.Context, hash string, t time.Time) (string, error) {
+	tags, err := lr.moduleTags(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		if tag.hash == hash {
+			return tag.version, nil
+		}
+	}
+	suffix := t.UTC().Format("20060102150405") + "-" + hash[:12]
+	for _, tag := range tags {
+		after, err := lr.descends(ctx, hash, tag.hash)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case !after:
+		case tag.semver.pre != "":
+			return tag.version + ".0." + suffix, nil
+		default:
+			return fmt.Sprintf("v%d.%d.%d-0.%s", tag.semver.major, tag.semver.minor, tag.semver.patch+1, suffix), nil
+		}
+	}
+	major := lr.majorVer
+	if major == "" {
+		major = "v0"
+	}
+	return major + ".0.0-" + suffix, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestSemverLess(t *testing.T) {
+	ordered := []string{"v0.1.0", "v1.0.0-alpha", "v1.0.0-alpha.1", "v1.0.0-alpha.beta", "v1.0.0-beta.2",
+		"v1.0.0-beta.11", "v1.0.0-rc.1", "v1.0.0", "v1.0.1", "v1.2.0", "v1.10.0", "v2.0.0"}
+	for i := range ordered {
+		for j := range ordered {
+			a, _ := parseSemver(ordered[i])
+			b, _ := parseSemver(ordered[j])
+			if got := a.less(b); got != (i < j) {
+				t.Errorf("%s < %s = %v", ordered[i], ordered[j], got)
+			}
+		}
+	}
+	for _, v := range []string{"1.0.0", "v1.0", "v1.0.0-", "v01.0.0", "v1.0.0+meta", "latest"} {
+		if _, ok := parseSemver(v); ok {
+			t.Errorf("%s taken as a version", v)
+		}
+	}
+}
+
+func TestTagVersion(t *testing.T) {
+	tags := []string{"v0.9.0", "v1.0.0", "v1.1.0-rc.1", "v2.0.0", "v2.1.0", "v10.0.0", "main",
+		"sub/v1.0.0", "sub/v2.0.0", "sub/deeper/v1.0.0", "subpkg/v1.2.0"}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"", []string{"v0.9.0", "v1.0.0", "v1.1.0-rc.1"}},
+		{"v2", []string{"v2.0.0", "v2.1.0"}},
+		{"sub", []string{"v1.0.0"}},
+		{"v2/sub", []string{"v2.0.0"}},
+		{"sub/deeper", []string{"v1.0.0"}},
+	}
+	for _, tt := range tests {
+		lr := &lookupResult{}
+		lr.setPath(tt.path)
+		var got []string
+		for _, tag := range tags {
+			if version, _, ok := lr.tagVersion(tag); ok {
+				got = append(got, version)
+				if name := lr.tagName(version); name != tag {
+					t.Errorf("path %q: tag of %s is %s, want %s", tt.path, version, name, tag)
+				}
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("path %q: versions %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCommitVersion(t *testing.T) {
+	gitCmd, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip(err)
+	}
+	ctx := context.Background()
+	f := &fakeGit{root: t.TempDir(), git: gitCmd}
+	commits := []selftestCommit{
+		{files: map[string]string{"go.mod": "module example.com/repo\n"}},
+		{files: map[string]string{"a.go": "package a\n"}, tags: []string{"v1.0.0", "sub/v1.2.0"}},
+		{files: map[string]string{"a.go": "package a // 2\n"}},
+		{files: map[string]string{"a.go": "package a // 3\n"}, tags: []string{"v1.1.0-rc.1", "v2.0.0"}},
+		{files: map[string]string{"a.go": "package a // 4\n"}},
+	}
+	gl, gh := fakeGitLabHost+"/grp/repo", fakeGitHubHost+"/grp/repo"
+	heads, err := f.build(ctx, []selftestRepo{{path: gl, commits: commits}, {path: gh, commits: commits}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	f.addr = srv.Listener.Addr().String()
+	glClient, err := gitlab.NewClient("", gitlab.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ghClient := github.NewClient(nil)
+	ghClient.BaseURL, _ = url.Parse(srv.URL + "/api/v3/")
+
+	tests := []struct {
+		path   string
+		commit int
+		want   string // followed by date-hash when a pseudo-version
+	}{
+		{"", 0, "v0.0.0-"},
+		{"", 1, "v1.0.0"},
+		{"", 2, "v1.0.1-0."},
+		{"", 3, "v1.1.0-rc.1"}, // v2.0.0 is of another major version
+		{"", 4, "v1.1.0-rc.1.0."},
+		{"v2", 2, "v2.0.0-"},
+		{"v2", 4, "v2.0.1-0."},
+		{"sub", 0, "v0.0.0-"},
+		{"sub", 1, "v1.2.0"},
+		{"sub", 4, "v1.2.1-0."},
+	}
+	for _, repo := range []struct {
+		path string
+		git  interface{}
+	}{{gl, glClient}, {gh, ghClient}} {
+		for _, tt := range tests {
+			lr := &lookupResult{git: repo.git, group: "grp", repo: "repo", groupRepo: "grp/repo"}
+			lr.setPath(tt.path)
+			c, _ := f.commit(ctx, repo.path, heads[repo.path][tt.commit])
+			want := tt.want
+			if strings.HasSuffix(want, "-") || strings.HasSuffix(want, ".") {
+				want += c.time.Format("20060102150405") + "-" + c.sha[:12]
+			}
+			got, err := lr.commitVersion(ctx, c.sha, c.time)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%s, path %q, commit %d: got %s, want %s", repo.path, tt.path, tt.commit, got, want)
+			}
+		}
+	}
+}
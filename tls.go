@@ -18,75 +18,49 @@ var (
 	caFile   = flag.String("CA", "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", "A PEM encoded CA's certificate file.")
 )
 
+var tlsLogger = newLogger("tls")
+
 var tlsConfig *tls.Config
 var caCertPool = x509.NewCertPool()
 
 func loadTLS() {
 	// Load CA cert
-	if *verbose {
-		log.Println("Loading CA certs")
-	}
+	tlsLogger.Debug("Loading CA certs", "file", *caFile)
 	err := LoadCertficatesFromFile(*caFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Setup HTTPS client
+	// Setup the TLS settings, the policy of the config is applied by
+	// setTLSPolicy
 	tlsConfig = &tls.Config{
-		RootCAs:            caCertPool,
-		ClientCAs:          caCertPool,
-		InsecureSkipVerify: false,
-		//ClientAuth:         tls.RequireAndVerifyClientCert,
-		Renegotiation: tls.RenegotiateOnceAsClient,
-
-		MinVersion:               tls.VersionTLS12,
-		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-		PreferServerCipherSuites: true,
-		CipherSuites: []uint16{
-			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
-		},
+		RootCAs:        caCertPool,
+		Renegotiation:  tls.RenegotiateOnceAsClient,
+		MinVersion:     tls.VersionTLS12,
+		CipherSuites:   defaultCiphers,
+		GetCertificate: getCertificate,
 	}
 
-	// Load client cert
+	// Load server cert
 	if *certFile != "" {
 		// If cert and key are the same file, as the key is not specified
 		if *keyFile == "" {
 			keyFile = certFile
 		}
-
-		if *verbose {
-			log.Println("Loading client cert", *certFile, "and key", *keyFile)
-		}
-		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
-		if err == nil {
-			// Load the certificate into the leaf
-			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
-				log.Fatal(err)
-			}
-			if *verbose {
-				log.Println("Loaded certificate, Sub:", certPKIXString(cert.Leaf.Subject, ","), "Issuer: ", certPKIXString(cert.Leaf.Issuer, ","))
-			}
-
-			if chains, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: caCertPool}); err != nil {
-				log.Fatal("Unable to verify provided cert with the provided CA", err, chains)
-			}
-
-			tlsConfig.Certificates = []tls.Certificate{cert}
+		p := &certPair{certFile: *certFile, keyFile: *keyFile}
+		if err := p.load(); err != nil {
+			log.Fatal(err)
 		}
+		serverCerts.pairs = []*certPair{p}
 	}
 
-	if *verbose {
-		log.Println("Assigning HTTP default client")
-	}
+	tlsLogger.Debug("Assigning HTTP default client")
+	// The server certificate is not sent to other servers, the git servers
+	// have their own transport settings
+	client := tlsConfig.Clone()
+	client.Certificates = nil
 	http.DefaultClient = &http.Client{
-		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Transport: &http.Transport{TLSClientConfig: client, Proxy: http.ProxyFromEnvironment},
 		//Timeout:   60 * time.Minute,
 	}
 
@@ -94,7 +68,6 @@ func loadTLS() {
 
 func certPKIXString(name pkix.Name, sep string) (out string) {
 	for i := len(name.Names) - 1; i >= 0; i-- {
-		//fmt.Println(name.Names[i])
 		if out != "" {
 			out += sep
 		}
@@ -104,6 +77,11 @@ func certPKIXString(name pkix.Name, sep string) (out string) {
 }
 
 func LoadCertficatesFromFile(path string) error {
+	return loadCertPool(path, caCertPool)
+}
+
+// loadCertPool adds the certificates of a PEM file to the pool.
+func loadCertPool(path string, pool *x509.CertPool) error {
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
@@ -117,20 +95,15 @@ func LoadCertficatesFromFile(path string) error {
 		if block.Type == "CERTIFICATE" {
 			cert, err := x509.ParseCertificate(block.Bytes)
 			if err != nil {
-				fmt.Println("warning: error parsing CA cert", err)
+				tlsLogger.Warn("Error parsing CA cert", "file", path, "err", err)
+				raw = rest
 				continue
 			}
-			//fmt.Printf("cert: %s  %#v\n", cert.Subject, cert.Subject)
-
-			if *verbose {
-				sub, is := certPKIXString(cert.Subject, ","), certPKIXString(cert.Issuer, ",")
-				if sub != is {
-					fmt.Printf("  Adding CA: %s (%02x) from %s\n", sub, cert.SerialNumber, is)
-				} else {
-					fmt.Printf("  Adding CA: %s (%02x)\n", sub, cert.SerialNumber)
-				}
+			if tlsLogger.Enabled(levelDebug) {
+				tlsLogger.Debug("Adding CA", "subject", certPKIXString(cert.Subject, ","),
+					"serial", fmt.Sprintf("%02x", cert.SerialNumber), "issuer", certPKIXString(cert.Issuer, ","))
 			}
-			caCertPool.AddCert(cert)
+			pool.AddCert(cert)
 		}
 		raw = rest
 	}
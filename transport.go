@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Settings of the connections to a git server.
+type yamlTransport struct {
+	CAFile     string `yaml:"ca-file"`     // CAs trusted, default the -CA bundle
+	ClientCert string `yaml:"client-cert"` // for mutual TLS, with the key in it or in client-key
+	ClientKey  string `yaml:"client-key"`
+	Proxy      string `yaml:"proxy"` // http(s)://host:port, none, or from HTTPS_PROXY by default
+
+	Timeout         time.Duration `yaml:"timeout"`      // to connect and get the reply headers
+	IdleTimeout     time.Duration `yaml:"idle-timeout"` // before an unused connection is closed
+	MaxConnsPerHost int           `yaml:"max-conns-per-host"`
+	MaxIdleConns    int           `yaml:"max-idle-conns"`
+
+	// Hosts the archive links of the git server may point to, ie:
+	// *.githubusercontent.com, besides the git server and its subdomains
+	Egress []string `yaml:"egress"`
+}
+
+// backend holds the connections to one git server.
+type backend struct {
+	transport http.RoundTripper
+	archive   *http.Client // for the archive links the git API hands out
+}
+
+// The client used for archive links when there is no backend.
+var archiveClient = &http.Client{Transport: &upstreamTransport{provider: "archive"}}
+
+func (b *backend) archiveClient() *http.Client {
+	if b == nil {
+		return archiveClient
+	}
+	return b.archive
+}
+
+func (b *backend) roundTripper() http.RoundTripper {
+	if b == nil {
+		return nil
+	}
+	return b.transport
+}
+
+// newBackend sets up the transport to a git server from its settings.
+func newBackend(t *yamlTransport, gitURL string) (*backend, error) {
+	if t == nil {
+		t = &yamlTransport{}
+	}
+	conf := &tls.Config{
+		RootCAs:       caCertPool,
+		MinVersion:    tls.VersionTLS12,
+		Renegotiation: tls.RenegotiateOnceAsClient,
+	}
+	if tlsConfig != nil {
+		conf.CipherSuites, conf.CurvePreferences = tlsConfig.CipherSuites, tlsConfig.CurvePreferences
+	}
+	if t.CAFile != "" {
+		conf.RootCAs = x509.NewCertPool()
+		if err := loadCertPool(t.CAFile, conf.RootCAs); err != nil {
+			return nil, err
+		}
+	}
+	if t.ClientCert != "" {
+		key := t.ClientKey
+		if key == "" {
+			key = t.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("client-cert: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	switch t.Proxy {
+	case "":
+	case "none":
+		proxy = nil
+	default:
+		u, err := url.Parse(t.Proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q, expected http(s)://host:port or none", t.Proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	timeout, idle, maxIdle := t.Timeout, t.IdleTimeout, t.MaxIdleConns
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	if idle <= 0 {
+		idle = 90 * time.Second
+	}
+	if maxIdle <= 0 {
+		maxIdle = 16
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       conf,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		IdleConnTimeout:       idle,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdle,
+		ForceAttemptHTTP2:     true,
+	}
+
+	allow := append([]string{}, t.Egress...)
+	if u, err := url.Parse(gitURL); err == nil && u.Hostname() != "" {
+		host := strings.ToLower(u.Hostname())
+		allow = append(allow, host, "*."+host)
+		allow = append(allow, archiveHosts[host]...)
+	}
+	return &backend{
+		transport: transport,
+		archive: &http.Client{Transport: &egressTransport{allow: allow,
+			base: &upstreamTransport{provider: "archive", base: transport}}},
+	}, nil
+}
+
+// The hosts the archive links of the public git servers point to, which are
+// not subdomains of their API.
+var archiveHosts = map[string][]string{
+	"github.com":     {"codeload.github.com", "*.githubusercontent.com"},
+	"api.github.com": {"codeload.github.com", "*.githubusercontent.com"},
+}
+
+// egressTransport refuses calls to hosts not in the allowlist, redirects
+// included as each is a call of its own.
+type egressTransport struct {
+	allow []string
+	base  http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hostAllowed(req.URL.Hostname(), t.allow) {
+		return nil, fmt.Errorf("egress to %s is not allowed, add it to the egress of the transport", req.URL.Hostname())
+	}
+	return t.base.RoundTrip(req)
+}
+
+// hostAllowed matches a host against names and *.domain patterns.
+func hostAllowed(host string, allow []string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range allow {
+		pattern = strings.ToLower(pattern)
+		if host == pattern || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
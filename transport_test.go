@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestHostAllowed(t *testing.T) {
+	allow := []string{"gitlab.corp", "*.GitHub.com", "api.example.com"}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"gitlab.corp", true},
+		{"GitLab.Corp", true},
+		{"api.github.com", true},
+		{"codeload.github.com", true},
+		{"a.b.github.com", true},
+		{"api.example.com", true},
+		{"github.com", false}, // *.domain is only for the subdomains
+		{"evilgithub.com", false},
+		{"github.com.evil.net", false},
+		{"gitlab.corp.evil.net", false},
+		{"www.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.host, allow); got != tt.want {
+			t.Errorf("hostAllowed(%q) = %t, want %t", tt.host, got, tt.want)
+		}
+	}
+	if hostAllowed("gitlab.corp", nil) {
+		t.Error("hostAllowed with no patterns allowed gitlab.corp")
+	}
+}
+
+func TestDefaultEgress(t *testing.T) {
+	tests := []struct {
+		gitURL string
+		host   string
+		want   bool
+	}{
+		{"https://api.github.com", "api.github.com", true},
+		{"https://api.github.com", "codeload.github.com", true},
+		{"https://api.github.com", "objects.githubusercontent.com", true},
+		{"https://github.com", "codeload.github.com", true},
+		{"https://api.github.com", "evil.com", false},
+		{"https://gitlab.corp", "gitlab.corp", true},
+		{"https://gitlab.corp", "cdn.gitlab.corp", true},
+		{"https://gitlab.corp", "objects.githubusercontent.com", false},
+		{"https://GitLab.Corp:8443", "gitlab.corp", true},
+	}
+	for _, tt := range tests {
+		b, err := newBackend(&yamlTransport{Egress: []string{"archives.corp"}}, tt.gitURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allow := b.archive.Transport.(*egressTransport).allow
+		if got := hostAllowed(tt.host, allow); got != tt.want {
+			t.Errorf("git-url %s: egress to %s allowed %t, want %t", tt.gitURL, tt.host, got, tt.want)
+		}
+		if !hostAllowed("archives.corp", allow) {
+			t.Errorf("git-url %s: configured egress not allowed", tt.gitURL)
+		}
+	}
+}
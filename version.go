@@ -1,39 +1,48 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"path"
 	"strings"
 	"time"
 
 	"github.com/google/go-github/v50/github"
-	"github.com/gorilla/mux"
 	"github.com/xanzy/go-gitlab"
 )
 
 func version(w http.ResponseWriter, r *http.Request) {
-	if *verbose {
-		log.Printf("Got version request: %#v", r)
-	}
 	// find a project ID by module name
-	module := mux.Vars(r)["module"]
-	lr, ok := Lookup(module)
+	module, version, ok := requestModule(w, r)
+	if !ok {
+		return
+	}
+	lr, ok := lookup(w, r, module)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	if !useClientCredentials(w, r, lr) {
+		return
+	}
 
-	ver, notice := getVersion(lr, mux.Vars(r)["version"])
+	ver, notice, err := getVersion(r.Context(), lr, version)
+	if err != nil {
+		upstreamError(w, err)
+		return
+	}
 	if notice != "" {
 		http.Error(w, notice, http.StatusNotFound)
 		return
 	}
+	auditOf(r).version(&ver)
 
-	if *verbose {
-		fmt.Printf("ver: %#v\n", ver)
+	if a, ok := cachedArtifacts(lr, module, ver.Version); ok &&
+		serveArtifact(w, r, a.info, "application/json") {
+		auditOf(r).cache(true)
+		return
 	}
 	json.NewEncoder(w).Encode(ver)
 }
@@ -49,19 +58,26 @@ type VersionData struct {
 	cacheDir, cachePath string
 }
 
-func getVersion(lr *lookupResult, version string) (reply VersionData, notice string) {
+// getVersion finds the commit of a version.  The notice tells why it was not
+// found, while an error is returned when the git server could not tell.
+func getVersion(ctx context.Context, lr *lookupResult, version string) (reply VersionData, notice string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, *apiTimeout)
+	defer cancel()
+	l := logOf(ctx, "lookup").With("module", lr.orig, "version", version)
 	var commitTime time.Time
 	var commitHash string
 
-	if data.LocalCache != "" {
-		if cache := checkCache(path.Join(lr.base, lr.group, lr.repo, lr.cleanPath), version); cache != nil {
-			if *verbose {
-				fmt.Println("found cache")
-			}
-			var err error
+	// The cached tarballs are named by the tags of the repo, a nested module
+	// has its own (sub/v1.0.0)
+	if lr.conf.LocalCache != "" && lr.cleanPath == "" {
+		if cache := checkCache(lr.conf.LocalCache, lr.baseGroupRepo, version); cache != nil {
+			l.Debug("Found version in the cache", "file", cache.path)
 			commitTime, err = time.ParseInLocation("20060102150405", cache.date, time.UTC)
+			if cache.ver == "" && isPseudoVersion(version) {
+				cache.ver = version // named by the commit only
+			}
 
-			if err == nil {
+			if err == nil && cache.ver != "" {
 				reply.Origin.Hash = cache.sha
 				reply.Origin.VCS = "cache"
 				reply.Time = commitTime.UTC().Format(time.RFC3339)
@@ -75,7 +91,8 @@ func getVersion(lr *lookupResult, version string) (reply VersionData, notice str
 
 	var search, versionDate string
 	var isVersion bool
-	if hyphen := strings.LastIndex(version, "-"); hyphen >= 20 && len(version) >= 34 && hyphen < len(version)-4 {
+	if isPseudoVersion(version) {
+		hyphen := strings.LastIndex(version, "-")
 		isVersion = true
 		search = version[hyphen+1:]
 		versionDate = version[hyphen-14 : hyphen]
@@ -83,42 +100,39 @@ func getVersion(lr *lookupResult, version string) (reply VersionData, notice str
 		search = version
 	}
 	search = strings.TrimSuffix(search, "+incompatible")
-
-	if *verbose {
-		log.Println("looking up", search)
+	if _, ok := parseSemver(search); ok && !isVersion {
+		search = lr.tagName(search)
 	}
 
+	l.Debug("Looking up commit", "search", search, "repo", lr.baseGroupRepo)
+
 	if reply.Origin.VCS == "" {
 		switch client := lr.git.(type) {
 		case *gitlab.Client:
-			commit, _, err := client.Commits.GetCommit(lr.groupRepo, search)
+			commit, _, err := client.Commits.GetCommit(lr.groupRepo, search, gitlab.WithContext(ctx))
+			if upstreamFailed(ctx, err) {
+				return reply, "", err
+			}
 			if err != nil {
 				notice = fmt.Sprintf("not found: %s@%s: invalid version: unknown revision, %s",
 					lr.base+"/"+lr.groupRepo, version, err)
-				return
+				return reply, notice, nil
 			}
 			commitTime = commit.CommittedDate.UTC()
 			commitHash = commit.ID
 			reply.Origin.VCS = "git"
-
-			{
-				//fmt.Println("looking up tag", version)
-				tag, _, _ := client.Tags.GetTag(lr.groupRepo, version)
-				//adat, _ := json.MarshalIndent(tag, "", "  ")
-				//fmt.Printf("commit: %s\n", adat)
-				if tag != nil {
-					reply.Version = tag.Name
-				}
-			}
 			reply.Origin.URL = "https://" + lr.baseGroupRepo + ".git"
 		case *github.Client:
 			{
 				commit, _, err := client.Repositories.GetCommit(ctx, lr.group, lr.repo, search,
 					&github.ListOptions{PerPage: 1})
+				if upstreamFailed(ctx, err) {
+					return reply, "", err
+				}
 				if err != nil {
 					notice = fmt.Sprintf("not found: %s@%s: invalid version: unknown revision, %s",
 						lr.base+"/"+lr.groupRepo, version, err)
-					return
+					return reply, notice, nil
 				}
 				if commit != nil {
 					commitTime = commit.Commit.Committer.Date.UTC()
@@ -146,30 +160,25 @@ func getVersion(lr *lookupResult, version string) (reply VersionData, notice str
 		return
 	}
 
-	// if the hash was not used to search
-	if !strings.HasPrefix(commitHash, search) {
+	// A branch or hash is named by its tag, or else a pseudo-version
+	if _, ok := parseSemver(strings.TrimSuffix(version, "+incompatible")); ok {
 		reply.Version = version
+	} else if reply.Version, err = lr.commitVersion(ctx, commitHash, commitTime); err != nil {
+		return reply, "", err
+	}
+	if !isPseudoVersion(reply.Version) {
+		reply.Origin.Ref = "refs/tags/" + lr.tagName(reply.Version)
 	}
 
 	// build output
 	date := commitTime.Format("20060102150405")
-	if data.LocalCache != "" {
-		reply.cacheDir = path.Join(data.LocalCache, lr.base, lr.groupRepo)
-	}
-
-	if reply.Version == "" {
-		reply.Version = fmt.Sprintf(
-			"v0.0.0-%s-%s", // v0.0.0 is only if there is no tag, otherwise tag name should be added
-			date, commitHash[0:12],
-		)
-		if reply.cacheDir != "" {
+	if lr.conf.LocalCache != "" {
+		reply.cacheDir = path.Join(lr.conf.LocalCache, cacheName(lr.baseGroupRepo))
+		if lr.cleanPath == "" {
+			reply.cachePath = reply.cacheDir + "/" + cacheName(reply.Version) + date + "-" + commitHash + ".tgz"
+		} else {
 			reply.cachePath = reply.cacheDir + "/" + date + "-" + commitHash + ".tgz"
 		}
-	} else {
-		if reply.cacheDir != "" {
-			reply.cachePath = reply.cacheDir + "/" + reply.Version + date + "-" + commitHash + ".tgz"
-		}
-		reply.Origin.Ref = "refs/tags/" + reply.Version
 	}
 
 	reply.Time = commitTime.Format(time.RFC3339)
@@ -179,6 +188,12 @@ func getVersion(lr *lookupResult, version string) (reply VersionData, notice str
 	if isVersion && versionDate != date {
 		notice = fmt.Sprintf("not found: %s@%s: invalid pseudo-version: does not match version-control timestamp (expected %s)",
 			lr.baseGroupRepo, versionDate, date)
+		return
+	}
+
+	// Make sure the version still points where it did before
+	if err := ledgerCheck(lr, ledgerEntry{Module: lr.orig, Version: reply.Version, Hash: commitHash}); err != nil {
+		notice = "not found: " + err.Error()
 	}
 	return
 }